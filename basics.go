@@ -1,6 +1,17 @@
 package muddy
 
-import "log"
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
 const RoomClassName = "Room"
 const PlayerClassName = "Player"
@@ -9,6 +20,9 @@ const ThingClassName = "Thing"
 const ItemClassName = "Item"
 const PartClassName = "Part"
 const ExitClassName = "Exit"
+const LockedExitClassName = "LockedExit"
+const PuzzleClassName = "Puzzle"
+const ModalClassName = "Modal"
 
 func (w *WorldBasics) AddPlayer(name string, initialRoom *Object) *Object {
 	if !initialRoom.IsInstanceOf(RoomClassName) {
@@ -17,8 +31,13 @@ func (w *WorldBasics) AddPlayer(name string, initialRoom *Object) *Object {
 	return w.World.AddObject(initialRoom, w.Player).Set("name", name).Set("connected", true)
 }
 
+func (w *WorldBasics) PlayerReconnected(playerID int) {
+	player := w.World.GetObject(playerID)
+	player.Set("connected", true)
+}
+
 func (w *WorldBasics) PlayerDisconnected(playerID int) {
-	player := w.World.objects[playerID]
+	player := w.World.GetObject(playerID)
 	player.Set("connected", false)
 }
 
@@ -31,51 +50,671 @@ func (w *WorldBasics) AddItem(room *Object, name string) *Object {
 }
 
 func (w *WorldBasics) AddExit(room *Object, destination *Object) *Object {
-	exit := w.World.AddObject(room, w.Exit).Set("destinationID", destination.ID)
+	exit := w.World.AddObject(room, w.Exit).Set("destination", destination)
 	return exit
 }
 
+// AddLockedExit adds an exit which starts out locked, and can only be unlocked by
+// a player carrying key
+func (w *WorldBasics) AddLockedExit(room *Object, destination *Object, key *Object) *Object {
+	return w.World.AddObject(room, w.LockedExit).Set("destination", destination).Set("key", key)
+}
+
+// AddPuzzle adds a puzzle which is solved by answering each of the questions.
+// The answers are only ever checked on the server.
+func (w *WorldBasics) AddPuzzle(room *Object, name string, title string, questions []string, answers []string) *Object {
+	if len(questions) != len(answers) {
+		panic("each question needs exactly one answer")
+	}
+	return w.World.AddObject(room, w.Puzzle).Set("name", name).Set("title", title).Set("questions", stringList(questions)).Set("answers", stringList(answers))
+}
+
+func stringList(strs []string) []interface{} {
+	list := make([]interface{}, len(strs))
+	for i, str := range strs {
+		list[i] = str
+	}
+	return list
+}
+
+func listStrings(list []interface{}) []string {
+	strs := make([]string, len(list))
+	for i, value := range list {
+		strs[i], _ = value.(string)
+	}
+	return strs
+}
+
+// The methods which views and the basic classes call can be overridden with
+// scripts, which return lists as []interface{} rather than the types the Go
+// methods declare. These read a method's result whichever it was, and make the
+// best of anything else rather than panicking.
+
+// resultList reads a result which should be a list, such as actions
+func resultList(result interface{}) []interface{} {
+	list, _ := result.([]interface{})
+	return list
+}
+
+// resultObjects reads a list of objects, leaving out anything which isn't one
+func resultObjects(result interface{}) []*Object {
+	if objs, ok := result.([]*Object); ok {
+		return objs
+	}
+	objs := make([]*Object, 0)
+	for _, value := range resultList(result) {
+		if obj, ok := value.(*Object); ok && obj != nil {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+// resultStrings reads a list of strings. Anything else becomes "", so that
+// each string stays at the same index.
+func resultStrings(result interface{}) []string {
+	if strs, ok := result.([]string); ok {
+		return strs
+	}
+	return listStrings(resultList(result))
+}
+
+// resultBools reads a list of bools. Anything else becomes false.
+func resultBools(result interface{}) []bool {
+	if bools, ok := result.([]bool); ok {
+		return bools
+	}
+	list := resultList(result)
+	bools := make([]bool, len(list))
+	for i, value := range list {
+		bools[i], _ = value.(bool)
+	}
+	return bools
+}
+
+const MaxPlayerNameLength = 24
+
+// MaxChatMessageLength is the longest thing a player can say in one go
+const MaxChatMessageLength = 500
+
+// MaxMessageLogLength is how many messages each player's scrollback keeps
+const MaxMessageLogLength = 50
+
+func checkChatMessage(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("nothing to say")
+	}
+	if utf8.RuneCountInString(text) > MaxChatMessageLength {
+		return "", fmt.Errorf("messages can't be longer than %d characters", MaxChatMessageLength)
+	}
+	return text, nil
+}
+
+// ValidatePlayerName checks that a name is an acceptable length and only
+// contains letters, digits, spaces and a little punctuation
+func ValidatePlayerName(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length == 0 {
+		return fmt.Errorf("name can't be blank")
+	}
+	if length > MaxPlayerNameLength {
+		return fmt.Errorf("name can't be longer than %d characters", MaxPlayerNameLength)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" -_'.", r) {
+			return fmt.Errorf("name can't contain %q", r)
+		}
+	}
+	return nil
+}
+
 func NewWorldBasics(world *World) *WorldBasics {
+	// methods which need the fields of basics (ie: Lobby) capture this and use it once it's filled in
+	var basics *WorldBasics
+
 	Named := world.ObjectClass.Subclass(NamedClassName).AddGetter("name", "<blank>")
+
+	// builders can reshape the world while playing. Their extra actions are
+	// listed in a section of their view, and each checks they're allowed.
+	checkBuilder := func(ctx *Context) error {
+		if ctx == nil || ctx.Player == nil {
+			return fmt.Errorf("only builders can do that")
+		}
+		if builder, _ := ctx.Player.GetBool("builder"); !builder {
+			return fmt.Errorf("only builders can do that")
+		}
+		return nil
+	}
+	rename := func(obj *Object, ctx *Context, name string) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("name can't be blank")
+		}
+		obj.Set("name", name)
+		return nil
+	}
+	// rooms are known by name in world definitions, so each must have its own,
+	// and only the lobby and nowhere can have theirs. room is nil for a new room.
+	checkRoomName := func(room *Object, name string) error {
+		builtin := room != nil && (room == basics.Lobby || room == basics.Nowhere)
+		if builtin && room.Get("name") != name {
+			return fmt.Errorf("the lobby and nowhere can't be renamed")
+		}
+		if !builtin && isBuiltinRoom(name) {
+			return fmt.Errorf("%q is the name of a built in room", name)
+		}
+		for _, other := range basics.World.FindAll(RoomClassName) {
+			if other != room && other.Get("name") == name {
+				return fmt.Errorf("there's already a room called %q", name)
+			}
+		}
+		return nil
+	}
+	describe := func(obj *Object, ctx *Context, description string) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		obj.Set("description", strings.TrimSpace(description))
+		return nil
+	}
+
 	Room := Named.Subclass(RoomClassName).AddGetter("description", "<blank>")
-	Thing := Named.Subclass(ThingClassName).AddGetter("actions", []interface{}{"Go"})
-	Item := Thing.Subclass(ItemClassName)
+	Room.AddTypedProperty("videoMode", StringType, VideoOff, OneOf(VideoOff, VideoAudio, VideoVideo))
+	Room.AddProperty("buildActions", []interface{}{"Rename", "Describe", "Dig", "CreateItem", "Export"}).AddMethod("getBuildActions", MakeGetter("buildActions"))
+	Room.AddPrompt("Rename", "New name").AddPrompt("Describe", "New description").AddPrompt("Dig", "Name of the new room").AddPrompt("CreateItem", "Name of the new item")
+	Room.AddMethod("Rename", func(obj *Object, ctx *Context, name string) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		if err := checkRoomName(obj, strings.TrimSpace(name)); err != nil {
+			return err
+		}
+		return rename(obj, ctx, name)
+	}).AddMethod("Describe", describe).AddMethod("Dig", func(obj *Object, ctx *Context, name string) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("name can't be blank")
+		}
+		if err := checkRoomName(nil, name); err != nil {
+			return err
+		}
+		// a new room with exits both ways
+		room := basics.AddRoom(name)
+		basics.AddExit(obj, room)
+		basics.AddExit(room, obj)
+		return nil
+	}).AddMethod("CreateItem", func(obj *Object, ctx *Context, name string) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("name can't be blank")
+		}
+		basics.AddItem(obj, name)
+		return nil
+	}).AddMethod("Export", func(obj *Object, ctx *Context) error {
+		// shows the builder the world as a world file, so their changes can be saved
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		def, err := basics.ExportDefinition()
+		if err != nil {
+			return err
+		}
+		data, err := def.Marshal()
+		if err != nil {
+			return err
+		}
+		ctx.Player.Call(ctx, "openModal", obj, "html", "<pre>"+html.EscapeString(string(data))+"</pre>", true)
+		return nil
+	})
+	// these decide what's listed in each section of the view of a room, and can be
+	// overridden to hide things or show things which aren't in the room
+	Room.AddMethod("getExits", func(obj *Object) []*Object {
+		return FilterByClass(obj.Children(), ExitClassName)
+	}).AddMethod("getContents", func(obj *Object) []*Object {
+		contents := make([]*Object, 0)
+		for _, thing := range FilterByClass(obj.Children(), ThingClassName) {
+			if !thing.IsInstanceOf(ExitClassName) {
+				contents = append(contents, thing)
+			}
+		}
+		return contents
+	}).AddMethod("getPlayers", func(obj *Object, ctx *Context) []*Object {
+		players := make([]*Object, 0)
+		for _, player := range FilterByClass(obj.Children(), PlayerClassName) {
+			if player != ctx.Player {
+				players = append(players, player)
+			}
+		}
+		return players
+	})
+	Thing := Named.Subclass(ThingClassName).AddGetter("actions", []interface{}{"Go"}).AddGetter("description", "")
+	// players who are focused on a Thing watch it, and the detail panel in their
+	// view shows its current state
+	Thing.AddTypedProperty("watchers", ListType, []interface{}{}).AddMethod("addWatch", func(obj *Object, player *Object) {
+		if !containsObject(resultObjects(obj.Call(nil, "getWatching")), player) {
+			obj.Append("watchers", player)
+		}
+	}).AddMethod("removeWatch", func(obj *Object, player *Object) {
+		watchers := make([]interface{}, 0)
+		for _, watcher := range resultObjects(obj.Call(nil, "getWatching")) {
+			if watcher != player {
+				watchers = append(watchers, watcher)
+			}
+		}
+		obj.Set("watchers", watchers)
+	}).AddMethod("getWatching", func(obj *Object) []*Object {
+		list, _ := obj.GetList("watchers")
+		watching := make([]*Object, 0, len(list))
+		for _, watcher := range list {
+			// skip watchers which have been removed from the world
+			if watcher, ok := watcher.(*Object); ok {
+				watching = append(watching, watcher)
+			}
+		}
+		return watching
+	}).AddMethod("Inspect", func(obj *Object, ctx *Context) {
+		ctx.Player.Call(ctx, "setFocus", obj)
+	}).AddMethod("StopInspecting", func(obj *Object, ctx *Context) {
+		if ctx.Player.Call(ctx, "getFocus") == obj {
+			ctx.Player.Call(ctx, "setFocus", nil)
+		}
+	})
+	Thing.AddProperty("buildActions", []interface{}{"Rename", "Describe", "Destroy"}).AddMethod("getBuildActions", MakeGetter("buildActions"))
+	Thing.AddPrompt("Rename", "New name").AddPrompt("Describe", "New description")
+	Thing.AddMethod("Rename", rename).AddMethod("Describe", describe).AddMethod("Destroy", func(obj *Object, ctx *Context) error {
+		if err := checkBuilder(ctx); err != nil {
+			return err
+		}
+		_, err := world.RemoveObject(obj, RemoveSubtree)
+		return err
+	})
+	// an item is owned by whoever it's a child of, so it's in a player's
+	// inventory when the player is its parent
+	ownerOf := func(item *Object) *Object {
+		if parent := item.Parent(); parent != nil && parent.IsInstanceOf(PlayerClassName) {
+			return parent
+		}
+		return nil
+	}
+	Item := Thing.Subclass(ItemClassName).AddMethod("getActions", func(obj *Object, ctx *Context) interface{} {
+		owner := ownerOf(obj)
+		if owner == nil {
+			return []interface{}{"Take", "Inspect"}
+		} else if owner == ctx.Player {
+			actions := []interface{}{"Drop"}
+			// Give needs a recipient, so there's one for each player who's here
+			for _, other := range owner.Parent().Children() {
+				if other != owner && other.IsInstanceOf(PlayerClassName) {
+					actions = append(actions, &Action{Label: "Give", Text: "Give to " + objectLabel(ctx, other), Args: []string{strconv.Itoa(other.ID)}})
+				}
+			}
+			return append(actions, "Inspect")
+		}
+		return []interface{}{}
+	}).AddMethod("Take", func(obj *Object, ctx *Context) error {
+		if owner := ownerOf(obj); owner != nil {
+			if owner == ctx.Player {
+				return fmt.Errorf("you already have that")
+			}
+			return fmt.Errorf("that belongs to %s", objectLabel(ctx, owner))
+		}
+		if obj.Parent() != ctx.Player.Parent() {
+			return fmt.Errorf("that isn't here")
+		}
+		ctx.Player.Call(ctx, "addToInventory", obj)
+		return nil
+	}).AddMethod("Drop", func(obj *Object, ctx *Context) error {
+		if ownerOf(obj) != ctx.Player {
+			return fmt.Errorf("you don't have that")
+		}
+		ctx.Player.Call(ctx, "removeFromInventory", obj)
+		return nil
+	}).AddMethod("Give", func(obj *Object, ctx *Context, recipient *Object) error {
+		if ownerOf(obj) != ctx.Player {
+			return fmt.Errorf("you don't have that")
+		}
+		if !recipient.IsInstanceOf(PlayerClassName) || recipient == ctx.Player {
+			return fmt.Errorf("you can only give things to other players")
+		}
+		if recipient.Parent() != ctx.Player.Parent() {
+			return fmt.Errorf("%s isn't here", objectLabel(ctx, recipient))
+		}
+		recipient.Call(ctx, "addToInventory", obj)
+		return nil
+	})
 	Part := Thing.Subclass(PartClassName)
-	Exit := Thing.Subclass(ExitClassName).AddMethod("getDestination", func(obj *Object) interface{} {
-		destinationID := obj.Get("destinationID").(int)
-		return world.objects[destinationID]
-	}).AddMethod("Go", func(obj *Object, ctx *Context) {
-		destination := world.objects[obj.Get("destinationID").(int)]
+	destinationOf := func(exit *Object) (*Object, error) {
+		destination, err := exit.GetRef("destination")
+		if err == nil && destination == nil {
+			err = fmt.Errorf("exit %d doesn't lead anywhere", exit.ID)
+		}
+		return destination, err
+	}
+	Exit := Thing.Subclass(ExitClassName).AddTypedProperty("destination", ObjectRefType, nil).AddProperty("name", "").AddMethod("getName", func(obj *Object, ctx *Context) interface{} {
+		// unless it's been given a name, an exit is named after where it leads
+		if name, _ := obj.GetString("name"); name != "" {
+			return name
+		}
+		destination, err := destinationOf(obj)
+		if err != nil || !destination.HasMethod("getName") {
+			return "<blank>"
+		}
+		return destination.Call(ctx, "getName")
+	}).AddMethod("getDestination", func(obj *Object) interface{} {
+		destination, err := destinationOf(obj)
+		if err != nil {
+			log.Printf("getDestination: %v", err)
+			return nil
+		}
+		return destination
+	}).AddMethod("Go", func(obj *Object, ctx *Context) error {
+		destination, err := destinationOf(obj)
+		if err != nil {
+			return err
+		}
 		world.Move(ctx.Player, destination)
+		// whatever they were looking at got left behind
+		ctx.Player.Call(ctx, "setFocus", nil)
+		return nil
 	})
 
-	LockedExit := Exit.Subclass("LockedExit").AddProperty("locked", true)
+	// a locked exit can be unlocked (and locked again) by a player carrying its key
+	hasKey := func(exit *Object, ctx *Context) bool {
+		key, _ := exit.GetRef("key")
+		return key != nil && key.Parent() == ctx.Player
+	}
+	var LockedExit *ClassDef
+	LockedExit = Exit.Subclass(LockedExitClassName).AddTypedProperty("locked", BoolType, true).AddTypedProperty("key", ObjectRefType, nil)
 	LockedExit.AddMethod("getActions", func(obj *Object, ctx *Context) interface{} {
-		actions := Exit.Call("getActions", obj, ctx).([]interface{})
+		actions := resultList(LockedExit.CallSuper("getActions", obj, ctx))
 		// if locked, filter "Go" out of the list of possible actions
-		if obj.Get("locked").(bool) {
-			newActions := make([]interface{}, len(actions))
+		if locked, _ := obj.GetBool("locked"); locked {
+			newActions := make([]interface{}, 0, len(actions))
 			for _, action := range actions {
-				if action.(string) != "Go" {
-					newActions = append(newActions, action)
+				switch a := action.(type) {
+				case string:
+					if a == "Go" {
+						continue
+					}
+				case *Action:
+					if a.Label == "Go" {
+						continue
+					}
 				}
+				newActions = append(newActions, action)
+			}
+			return append(newActions, "Unlock")
+		}
+		return append(append([]interface{}(nil), actions...), "Lock")
+	}).AddMethod("Go", func(obj *Object, ctx *Context) error {
+		if locked, _ := obj.GetBool("locked"); locked {
+			return fmt.Errorf("it's locked")
+		}
+		_, err := LockedExit.TryCallSuper("Go", obj, ctx)
+		return err
+	}).AddMethod("Unlock", func(obj *Object, ctx *Context) error {
+		if !hasKey(obj, ctx) {
+			return fmt.Errorf("you don't have the key")
+		}
+		obj.Set("locked", false)
+		return nil
+	}).AddMethod("Lock", func(obj *Object, ctx *Context) error {
+		if !hasKey(obj, ctx) {
+			return fmt.Errorf("you don't have the key")
+		}
+		obj.Set("locked", true)
+		return nil
+	})
+	// a puzzle opens a form with a row per question. Players' guesses are checked
+	// against the answers here, so the answers are never sent to clients.
+	Puzzle := Thing.Subclass(PuzzleClassName).AddProperty("actions", []interface{}{"Solve", "Inspect"}).AddTypedProperty("title", StringType, "")
+	Puzzle.AddTypedProperty("questions", ListType, []interface{}{}).AddTypedProperty("answers", ListType, []interface{}{})
+	Puzzle.AddMethod("Solve", func(obj *Object, ctx *Context) {
+		ctx.Player.Call(ctx, "openForm", obj)
+	}).AddMethod("getQuestions", func(obj *Object) []string {
+		questions, _ := obj.GetList("questions")
+		return listStrings(questions)
+	}).AddMethod("checkAnswers", func(obj *Object, guesses []string) []bool {
+		// one for each question, since questions and answers can be set separately.
+		// A question with no answer can never be right.
+		questions, _ := obj.GetList("questions")
+		list, _ := obj.GetList("answers")
+		answers := listStrings(list)
+		correct := make([]bool, len(questions))
+		for i := range correct {
+			correct[i] = i < len(answers) && i < len(guesses) && strings.EqualFold(strings.TrimSpace(guesses[i]), strings.TrimSpace(answers[i]))
+		}
+		return correct
+	}).AddMethod("onSolved", func(obj *Object, ctx *Context, player *Object) {
+		if modal, ok := player.Call(ctx, "findModal", obj).(*Object); ok {
+			player.Call(ctx, "closeModal", modal, "done")
+		}
+		player.Call(ctx, "receiveMessage", fmt.Sprintf("You solved %s!", objectLabel(ctx, obj)))
+	})
+
+	Player := Named.Subclass(PlayerClassName).AddTypedProperty("builder", BoolType, false)
+	Player.AddMethod("setName", func(obj *Object, ctx *Context, name string) error {
+		name = strings.TrimSpace(name)
+		if err := ValidatePlayerName(name); err != nil {
+			return err
+		}
+		for _, other := range world.FindAll(PlayerClassName) {
+			// names which aren't strings can't clash with this one
+			otherName, err := other.GetString("name")
+			if other != obj && err == nil && strings.EqualFold(otherName, name) {
+				return fmt.Errorf("the name \"%s\" is already taken", name)
+			}
+		}
+		wasUnnamed := obj.Get("name") == ""
+		obj.Set("name", name)
+		// now that they have a name, they can leave nowhere and start playing
+		if wasUnnamed {
+			world.Move(obj, basics.Lobby)
+		}
+		return nil
+	}).AddMethod("getInventory", func(obj *Object) []*Object {
+		return FilterByClass(obj.Children(), ItemClassName)
+	}).AddMethod("addToInventory", func(obj *Object, item *Object) {
+		world.Move(item, obj)
+	}).AddMethod("removeFromInventory", func(obj *Object, item *Object) {
+		// whatever the player is holding ends up in the room they're in
+		world.Move(item, obj.Parent())
+	}).AddTypedProperty("focus", ObjectRefType, nil).AddMethod("setFocus", func(obj *Object, ctx *Context, thing *Object) {
+		if previous, _ := obj.GetRef("focus"); previous != nil && previous.HasMethod("removeWatch") {
+			previous.Call(ctx, "removeWatch", obj)
+		}
+		obj.Set("focus", thing)
+		if thing != nil && thing.HasMethod("addWatch") {
+			thing.Call(ctx, "addWatch", obj)
+		}
+	}).AddMethod("getFocus", func(obj *Object) interface{} {
+		// returned as an interface{} so that no focus compares equal to nil
+		if focus, _ := obj.GetRef("focus"); focus != nil {
+			return focus
+		}
+		return nil
+	})
+	// chat. Everything a player hears is kept in a short scrollback which is shown in their view
+	Player.AddTypedProperty("messages", ListType, []interface{}{}).AddMethod("receiveMessage", func(obj *Object, message string) {
+		list, _ := obj.GetList("messages")
+		messages := append(append([]interface{}(nil), list...), message)
+		if len(messages) > MaxMessageLogLength {
+			messages = messages[len(messages)-MaxMessageLogLength:]
+		}
+		obj.Set("messages", messages)
+	}).AddMethod("getMessages", func(obj *Object) []string {
+		list, _ := obj.GetList("messages")
+		messages := make([]string, 0, len(list))
+		for _, message := range list {
+			if message, ok := message.(string); ok {
+				messages = append(messages, message)
+			}
+		}
+		return messages
+	}).AddMethod("say", func(obj *Object, ctx *Context, text string) error {
+		text, err := checkChatMessage(text)
+		if err != nil {
+			return err
+		}
+		for _, listener := range FilterByClass(obj.Parent().Children(), PlayerClassName) {
+			listener.Call(ctx, "receiveMessage", fmt.Sprintf("%s says: %s", objectLabel(ctx, obj), text))
+		}
+		return nil
+	}).AddMethod("shout", func(obj *Object, ctx *Context, text string) error {
+		text, err := checkChatMessage(text)
+		if err != nil {
+			return err
+		}
+		room := obj.Parent()
+		for _, listener := range FilterByClass(room.Children(), PlayerClassName) {
+			listener.Call(ctx, "receiveMessage", fmt.Sprintf("%s shouts: %s", objectLabel(ctx, obj), text))
+		}
+		// shouts carry as far as the rooms next door
+		heard := []*Object{room}
+		for _, exit := range resultObjects(room.Call(ctx, "getExits")) {
+			destination, ok := exit.Call(ctx, "getDestination").(*Object)
+			if !ok || containsObject(heard, destination) {
+				continue
+			}
+			heard = append(heard, destination)
+			for _, listener := range FilterByClass(destination.Children(), PlayerClassName) {
+				listener.Call(ctx, "receiveMessage", fmt.Sprintf("%s shouts from %s: %s", objectLabel(ctx, obj), objectLabel(ctx, room), text))
+			}
+		}
+		return nil
+	}).AddMethod("whisper", func(obj *Object, ctx *Context, recipient *Object, text string) error {
+		text, err := checkChatMessage(text)
+		if err != nil {
+			return err
+		}
+		if recipient == obj || !recipient.IsInstanceOf(PlayerClassName) || recipient.Parent() != obj.Parent() {
+			return fmt.Errorf("there's nobody here to whisper to")
+		}
+		recipient.Call(ctx, "receiveMessage", fmt.Sprintf("%s whispers: %s", objectLabel(ctx, obj), text))
+		obj.Call(ctx, "receiveMessage", fmt.Sprintf("You whisper to %s: %s", objectLabel(ctx, recipient), text))
+		return nil
+	})
+	// a modal is shown on top of a player's view until they dismiss it or say
+	// they're done with it. Open modals are children of the player, and the
+	// first one is the one they see.
+	Modal := world.ObjectClass.Subclass(ModalClassName).AddTypedProperty("kind", StringType, "html", OneOf("form", "url", "html"))
+	Modal.AddTypedProperty("content", StringType, "").AddTypedProperty("showDone", BoolType, false).AddTypedProperty("opener", ObjectRefType, nil)
+	// only used by forms: the player's latest guess for each row
+	Modal.AddTypedProperty("guesses", ListType, []interface{}{})
+
+	modalsOf := func(player *Object) []*Object {
+		modals := make([]*Object, 0)
+		for _, modal := range FilterByClass(player.Children(), ModalClassName) {
+			// there's nothing to show in a form once the puzzle which opened it has gone
+			if opener, _ := modal.GetRef("opener"); opener == nil && modal.Get("kind") == "form" {
+				continue
+			}
+			modals = append(modals, modal)
+		}
+		return modals
+	}
+	// A player has at most one modal per opener. Opening another modal from the
+	// same object replaces it where it is, and modals from other objects queue
+	// up behind whatever the player is already looking at.
+	Player.AddMethod("openModal", func(obj *Object, opener *Object, kind string, content string, showDone bool) *Object {
+		var modal *Object
+		for _, existing := range modalsOf(obj) {
+			if ref, _ := existing.GetRef("opener"); opener != nil && ref == opener {
+				modal = existing
+			}
+		}
+		if modal == nil {
+			modal = world.AddObject(obj, Modal).Set("opener", opener)
+		}
+		modal.Set("kind", kind).Set("content", content).Set("showDone", showDone).Set("guesses", []interface{}{})
+		return modal
+	}).AddMethod("getModals", func(obj *Object) []*Object {
+		return modalsOf(obj)
+	}).AddMethod("getModal", func(obj *Object) interface{} {
+		if modals := modalsOf(obj); len(modals) > 0 {
+			return modals[0]
+		}
+		return nil
+	}).AddMethod("findModal", func(obj *Object, opener *Object) interface{} {
+		for _, modal := range modalsOf(obj) {
+			if ref, _ := modal.GetRef("opener"); ref == opener {
+				return modal
 			}
-			actions = newActions
 		}
-		return actions
+		return nil
+	}).AddMethod("closeModal", func(obj *Object, ctx *Context, modal *Object, outcome string) error {
+		if modal.Parent() != obj || !modal.IsInstanceOf(ModalClassName) {
+			return fmt.Errorf("that isn't open")
+		}
+		if outcome != "done" && outcome != "dismiss" {
+			return fmt.Errorf("unknown outcome: %s", outcome)
+		}
+		opener, _ := modal.GetRef("opener")
+		if _, err := world.RemoveObject(modal, RemoveSubtree); err != nil {
+			return err
+		}
+		// let whatever opened it know, so it can react to the player being done
+		if opener != nil && opener.HasMethod("onModalClosed") {
+			opener.Call(ctx, "onModalClosed", obj, outcome)
+		}
+		return nil
+	}).AddMethod("openForm", func(obj *Object, ctx *Context, form *Object) {
+		questions := resultStrings(form.Call(ctx, "getQuestions"))
+		modal, ok := obj.Call(ctx, "openModal", form, "form", "", false).(*Object)
+		if !ok {
+			return
+		}
+		modal.Set("guesses", stringList(make([]string, len(questions))))
+	}).AddMethod("submitForm", func(obj *Object, ctx *Context, modal *Object, guesses []string) error {
+		form, _ := modal.GetRef("opener")
+		if modal.Parent() != obj || form == nil || modal.Get("kind") != "form" {
+			return fmt.Errorf("that form isn't open")
+		}
+		rows := len(resultStrings(form.Call(ctx, "getQuestions")))
+		if len(guesses) != rows {
+			return fmt.Errorf("expected %d answers but got %d", rows, len(guesses))
+		}
+		modal.Set("guesses", stringList(guesses))
+		correct := resultBools(form.Call(ctx, "checkAnswers", guesses))
+		if len(correct) < rows {
+			return nil
+		}
+		for _, correct := range correct {
+			if !correct {
+				return nil
+			}
+		}
+		form.Call(ctx, "onSolved", obj)
+		return nil
 	})
-	Player := Named.Subclass(PlayerClassName)
-
-	basics := &WorldBasics{World: world,
-		Named:    Named,
-		Room:     Room,
-		Thing:    Thing,
-		Item:     Item,
-		Part:     Part,
-		Exit:     Exit,
-		Player:   Player,
-		events:   make(chan interface{}),
-		sessions: make(map[string]*Session)}
+
+	for _, classDef := range []*ClassDef{Named, Room, Thing, Item, Part, Exit, LockedExit, Puzzle, Modal, Player} {
+		world.RegisterClass(classDef)
+	}
+
+	basics = &WorldBasics{World: world,
+		Named:      Named,
+		Room:       Room,
+		Thing:      Thing,
+		Item:       Item,
+		Part:       Part,
+		Exit:       Exit,
+		LockedExit: LockedExit,
+		Puzzle:     Puzzle,
+		Modal:      Modal,
+		Player:     Player,
+		events:     make(chan interface{}),
+		sessions:   make(map[string]*Session)}
 
 	basics.Lobby = basics.AddRoom("lobby")
 	basics.Lobby.Set("description", "A grand lobby")
@@ -84,6 +723,22 @@ func NewWorldBasics(world *World) *WorldBasics {
 	return basics
 }
 
+// UnmarshalSnapshot restores the world from a snapshot taken of a world which was
+// also created via NewWorldBasics.
+func (w *WorldBasics) UnmarshalSnapshot(data []byte) error {
+	lobbyID, nowhereID := w.Lobby.ID, w.Nowhere.ID
+	err := w.World.UnmarshalSnapshot(data)
+	if err != nil {
+		return err
+	}
+	w.Lobby = w.World.GetObject(lobbyID)
+	w.Nowhere = w.World.GetObject(nowhereID)
+	if w.Lobby == nil || w.Nowhere == nil {
+		return fmt.Errorf("snapshot is missing the lobby or nowhere room")
+	}
+	return nil
+}
+
 type WorldBasics struct {
 	World    *World
 	sessions map[string]*Session
@@ -91,11 +746,21 @@ type WorldBasics struct {
 	// channels used by GameLoop
 	events chan interface{}
 
+	// clients which send this token make their player a builder, who can
+	// use the builder actions. If it's empty, nobody can.
+	BuilderToken string
+
 	Named *ClassDef
 	// base class for everything else
 	// methods: GetName() -> str
 
 	Room *ClassDef
+	// methods:
+	//  getExits() -> List[Exit]
+	//  getContents() -> List[Thing]
+	//  getPlayers() -> List[Player] (not including the player looking)
+	//  getBuildActions() -> List[str]
+	//  Rename(str), Describe(str), Dig(str), CreateItem(str), Export() (builders only)
 	// 	GetDescription func(*Room, *Context) string
 	// 	GetImage func(*Room, *Context) string
 	// 	GetExits func(*Room, *Context) []*Exit
@@ -105,14 +770,19 @@ type WorldBasics struct {
 	// something that you can interact with
 	Thing *ClassDef
 	// methods:
-	//  GetActions() -> List[str]
-	//  GetDescription() -> str
-	//  AddWatch(Player)
-	//  RemoveWatch(Player)
-	//  GetWatching() -> List[Player]
+	//  getActions() -> List[str or *Action] (a str is a method to call with no arguments)
+	//  getBuildActions() -> List[str]
+	//  getDescription() -> str
+	//  addWatch(Player)
+	//  removeWatch(Player)
+	//  getWatching() -> List[Player]
+	//  Inspect(), StopInspecting() (set or clear the player's focus)
+	//  Rename(str), Describe(str), Destroy() (builders only)
 
 	// subclass of Thing, but also implies you can pick it up
 	Item *ClassDef
+	// methods:
+	//  Take(), Drop(), Give(Player)
 
 	// subclass of Thing, which represents part of another thing (as identified by its "owner")
 	Part *ClassDef
@@ -121,16 +791,40 @@ type WorldBasics struct {
 	// methods: GetDestination() -> Room
 
 	LockedExit *ClassDef
+	// methods: Unlock(), Lock() (both require the player to be carrying the key)
+
+	// subclass of Thing, which players solve by filling in a form
+	Puzzle *ClassDef
+	// methods:
+	//  Solve() (opens the form)
+	//  getQuestions() -> List[str]
+	//  checkAnswers(List[str]) -> List[bool] (one for each question)
+	//  onSolved(Player) (called once every answer is right, closes the form)
+
+	// shown over a player's view. kind is one of "form", "url" or "html", and
+	// content is the URL or HTML to show
+	Modal *ClassDef
 
 	Player *ClassDef
 	// methods:
-	// GetInventory() -> List[Object]
-	// AddToInventory(Object)
-	// RemoveFromInventory(Object)
-	// SetFocus(Thing)
-	// GetFocus() -> Thing
+	// setName(str) (also moves players without a name to the lobby)
+	// getInventory() -> List[Item]
+	// addToInventory(Item)
+	// removeFromInventory(Item) (drops it in the player's room)
+	// setFocus(Thing) (nil to clear it)
+	// getFocus() -> Thing
+	// receiveMessage(str) (adds to the scrollback)
+	// getMessages() -> List[str]
+	// say(str), shout(str) (also heard in adjacent rooms), whisper(Player, str)
+	// openModal(opener, kind, content, showDone) -> Modal (replaces the opener's modal if it has one open, otherwise queues)
+	// getModals() -> List[Modal]
+	// getModal() -> Modal (the one the player sees)
+	// findModal(opener) -> Modal
+	// closeModal(Modal, "done" or "dismiss") (calls onModalClosed(Player, outcome) on the opener)
+	// openForm(Puzzle)
+	// submitForm(Modal, List[str]) (checks the guesses and calls onSolved if they're all right)
 
-	// room where players start
+	// room where players start, once they've chosen a name
 	Lobby *Object
 
 	// room where objects live before they're needed
@@ -146,6 +840,10 @@ type DisconnectedPlayerEvent struct {
 	sessionID string
 }
 
+type ReconnectedPlayerEvent struct {
+	sessionID string
+}
+
 type GameEvent struct {
 	sessionID string
 	objectID  int
@@ -153,65 +851,312 @@ type GameEvent struct {
 	args      []string
 }
 
-func (world *WorldBasics) eventLoop(newSnapshot func(*World)) {
-	// read from events until channel is closed. For each event, update world and
-	// send a fresh snapshot of the world to snapshotChan
+type SetNameEvent struct {
+	sessionID string
+	name      string
+}
+
+// FormSubmitEvent carries a player's guesses for each row of one of their form modals
+type FormSubmitEvent struct {
+	sessionID string
+	modalID   int
+	guesses   []string
+}
+
+// CloseModalEvent is a player closing a modal. outcome is "done" or "dismiss".
+type CloseModalEvent struct {
+	sessionID string
+	modalID   int
+	outcome   string
+}
+
+// BuilderEvent is a client sending a builder token, which makes its session's
+// player a builder if the token is the world's BuilderToken
+type BuilderEvent struct {
+	sessionID string
+	token     string
+}
+
+// ChatEvent is a player saying something. mode is one of "say", "shout" or
+// "whisper", and recipientID is only used when whispering.
+type ChatEvent struct {
+	sessionID   string
+	mode        string
+	text        string
+	recipientID int
+}
+
+// eventLoop processes events until the events channel is closed. sendError is
+// used to report problems with a GameEvent back to just the session which sent it.
+func (world *WorldBasics) eventLoop(newSnapshot func(*World), sendError func(sessionID string, err error)) {
+	// read from events until channel is closed, also running timers when they're
+	// due. After each event or batch of timers, send a fresh snapshot of the world
+	// to snapshotChan
+	scheduler := world.World.Scheduler
+	clock := world.World.Clock
 	for {
-		log.Printf("Reading event chan %v", world.events)
-		event, ok := <-world.events
-		if !ok {
-			break
+		var timer ClockTimer
+		var timerChan <-chan time.Time
+		if next, ok := scheduler.Next(); ok {
+			timer = clock.NewTimer(next.Sub(clock.Now()))
+			timerChan = timer.C()
 		}
-		log.Printf("got event %v", event)
 
-		switch e := event.(type) {
-		case *NewPlayerEvent:
-			handleNewPlayerEvent(world, e)
-		case *DisconnectedPlayerEvent:
-			handleDisconnectedPlayerEvent(world, e)
-		case *GameEvent:
-			handleGameEvent(world, e)
+		log.Printf("Reading event chan %v", world.events)
+		select {
+		case <-timerChan:
+			ran := scheduler.RunDue()
+			log.Printf("ran %d timers", ran)
+		case event, ok := <-world.events:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				return
+			}
+			log.Printf("got event %v", event)
+			handleEvent(world, event, sendError)
 		}
 
+		world.dropRemovedSessions()
+
 		log.Printf("Sending out snapshot")
 		// take a snapshot and notify anyone listening the new state of the world
-		snapshot := world.World.Clone()
+		snapshot := world.World.Snapshot()
 		newSnapshot(snapshot)
 	}
 }
 
+// dropRemovedSessions forgets the sessions whose players have been removed from
+// the world, so that nothing more is done on their behalf
+func (world *WorldBasics) dropRemovedSessions() {
+	for sessionID, session := range world.sessions {
+		if world.World.GetObject(session.playerID) == nil {
+			log.Printf("Dropping session %s, player %d was removed", sessionID, session.playerID)
+			delete(world.sessions, sessionID)
+		}
+	}
+}
+
+func handleEvent(world *WorldBasics, event interface{}, sendError func(sessionID string, err error)) {
+	// handlers report failures as errors, but anything they miss shouldn't
+	// take the whole world down with it
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handling %T panicked: %v\n%s", event, r, debug.Stack())
+		}
+	}()
+
+	switch e := event.(type) {
+	case *NewPlayerEvent:
+		handleNewPlayerEvent(world, e)
+	case *DisconnectedPlayerEvent:
+		handleDisconnectedPlayerEvent(world, e)
+	case *ReconnectedPlayerEvent:
+		handleReconnectedPlayerEvent(world, e)
+	case *GameEvent:
+		err := handleGameEvent(world, e)
+		if err != nil {
+			log.Printf("Game event from session %s failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	case *SetNameEvent:
+		err := handleSetNameEvent(world, e)
+		if err != nil {
+			log.Printf("Setting name for session %s failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	case *ChatEvent:
+		err := handleChatEvent(world, e)
+		if err != nil {
+			log.Printf("Chat from session %s failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	case *FormSubmitEvent:
+		err := handleFormSubmitEvent(world, e)
+		if err != nil {
+			log.Printf("Form submission from session %s failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	case *CloseModalEvent:
+		err := handleCloseModalEvent(world, e)
+		if err != nil {
+			log.Printf("Closing modal for session %s failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	case *BuilderEvent:
+		err := handleBuilderEvent(world, e)
+		if err != nil {
+			log.Printf("Making session %s a builder failed: %v", e.sessionID, err)
+			sendError(e.sessionID, err)
+		}
+	}
+}
+
 func handleNewPlayerEvent(world *WorldBasics, e *NewPlayerEvent) {
-	player := world.AddPlayer("", world.Lobby)
+	// players wait in nowhere until they've chosen a name
+	player := world.AddPlayer("", world.Nowhere)
 	world.sessions[e.sessionID] = &Session{playerID: player.ID}
 	e.playerIDChan <- player.ID
 	close(e.playerIDChan)
 }
 
+func handleSetNameEvent(world *WorldBasics, e *SetNameEvent) error {
+	session := world.sessions[e.sessionID]
+	if session == nil {
+		return fmt.Errorf("invalid sessionID: %s", e.sessionID)
+	}
+
+	player := world.World.GetObject(session.playerID)
+	if player == nil {
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+
+	ctx := &Context{Player: player, World: world.World}
+	_, err := player.TryCall(ctx, "setName", e.name)
+	return err
+}
+
+func handleChatEvent(world *WorldBasics, e *ChatEvent) error {
+	session := world.sessions[e.sessionID]
+	if session == nil {
+		return fmt.Errorf("invalid sessionID: %s", e.sessionID)
+	}
+
+	player := world.World.GetObject(session.playerID)
+	if player == nil {
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+	// players waiting in nowhere can't be heard until they've joined
+	if name, _ := player.GetString("name"); name == "" {
+		return fmt.Errorf("choose a name before chatting")
+	}
+
+	ctx := &Context{Player: player, World: world.World}
+	switch e.mode {
+	case "say", "shout":
+		_, err := player.TryCall(ctx, e.mode, e.text)
+		return err
+	case "whisper":
+		recipient := world.World.GetObject(e.recipientID)
+		if recipient == nil {
+			return fmt.Errorf("invalid objectID: %d", e.recipientID)
+		}
+		_, err := player.TryCall(ctx, "whisper", recipient, e.text)
+		return err
+	}
+	return fmt.Errorf("unknown chat mode: %s", e.mode)
+}
+
+func handleFormSubmitEvent(world *WorldBasics, e *FormSubmitEvent) error {
+	session := world.sessions[e.sessionID]
+	if session == nil {
+		return fmt.Errorf("invalid sessionID: %s", e.sessionID)
+	}
+
+	player := world.World.GetObject(session.playerID)
+	if player == nil {
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+
+	modal := world.World.GetObject(e.modalID)
+	if modal == nil {
+		return fmt.Errorf("invalid objectID: %d", e.modalID)
+	}
+
+	ctx := &Context{Player: player, World: world.World}
+	_, err := player.TryCall(ctx, "submitForm", modal, e.guesses)
+	return err
+}
+
+func handleCloseModalEvent(world *WorldBasics, e *CloseModalEvent) error {
+	session := world.sessions[e.sessionID]
+	if session == nil {
+		return fmt.Errorf("invalid sessionID: %s", e.sessionID)
+	}
+
+	player := world.World.GetObject(session.playerID)
+	if player == nil {
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+
+	modal := world.World.GetObject(e.modalID)
+	if modal == nil {
+		return fmt.Errorf("invalid objectID: %d", e.modalID)
+	}
+
+	ctx := &Context{Player: player, World: world.World}
+	_, err := player.TryCall(ctx, "closeModal", modal, e.outcome)
+	return err
+}
+
+func handleBuilderEvent(world *WorldBasics, e *BuilderEvent) error {
+	session := world.sessions[e.sessionID]
+	if session == nil {
+		return fmt.Errorf("invalid sessionID: %s", e.sessionID)
+	}
+
+	player := world.World.GetObject(session.playerID)
+	if player == nil {
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+
+	if world.BuilderToken == "" || subtle.ConstantTimeCompare([]byte(e.token), []byte(world.BuilderToken)) != 1 {
+		return fmt.Errorf("invalid builder token")
+	}
+	player.Set("builder", true)
+	return nil
+}
+
 func handleDisconnectedPlayerEvent(world *WorldBasics, e *DisconnectedPlayerEvent) {
 	session := world.sessions[e.sessionID]
+	if session == nil {
+		return
+	}
 	world.PlayerDisconnected(session.playerID)
 }
 
-func handleGameEvent(world *WorldBasics, event *GameEvent) {
-	target := world.World.objects[event.objectID]
-	if target == nil {
-		log.Printf("Invalid objectID: %d", event.objectID)
+func handleReconnectedPlayerEvent(world *WorldBasics, e *ReconnectedPlayerEvent) {
+	session := world.sessions[e.sessionID]
+	if session == nil {
 		return
 	}
+	world.PlayerReconnected(session.playerID)
+}
+
+func handleGameEvent(world *WorldBasics, event *GameEvent) (err error) {
+	target := world.World.GetObject(event.objectID)
+	if target == nil {
+		return fmt.Errorf("invalid objectID: %d", event.objectID)
+	}
 
 	session := world.sessions[event.sessionID]
 	if session == nil {
-		log.Printf("Invalid sessionID: %s", event.sessionID)
-		return
+		return fmt.Errorf("invalid sessionID: %s", event.sessionID)
 	}
 
-	player := world.World.objects[session.playerID]
+	player := world.World.GetObject(session.playerID)
 	if player == nil {
-		log.Printf("Invalid playerID: %d", session.playerID)
-		return
+		return fmt.Errorf("invalid playerID: %d", session.playerID)
+	}
+
+	// a method which panics shouldn't stop the event loop for everyone, so
+	// report it to the player who called it like any other failure
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Call to %s on object %d panicked: %v\n%s", event.method, target.ID, r, debug.Stack())
+			err = &MethodError{ClassName: target.state().classDef.Name, Method: event.method, Err: ErrPanicked, Detail: fmt.Sprint(r)}
+		}
+	}()
+
+	// only allow calling methods which the player can see as an action on an object in their view
+	view := world.World.GetView(player.ID)
+	if !view.HasAction(target.ID, event.method, event.args) {
+		log.Printf("Rejected call from player %d: %s on object %d is not one of their actions", player.ID, event.method, target.ID)
+		return &MethodError{Method: event.method, Err: ErrNotAllowed, Detail: fmt.Sprintf("object %d", target.ID)}
 	}
 
-	ctx := &Context{Player: player}
+	ctx := &Context{Player: player, World: world.World}
 
 	// copy array to one of the right type... Kind of annoying that this is necessary and not something
 	// the spread operator could do for us.
@@ -220,5 +1165,6 @@ func handleGameEvent(world *WorldBasics, event *GameEvent) {
 		args[i] = event.args[i]
 	}
 
-	target.Call(ctx, event.method, args...)
+	_, err = target.TryCall(ctx, event.method, args...)
+	return err
 }
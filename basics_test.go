@@ -0,0 +1,268 @@
+package muddy
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGameEventAllowlist(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	beach := basics.AddRoom("Beach")
+	castle := basics.AddRoom("Castle")
+	key := basics.AddItem(castle, "key")
+	gate := basics.AddLockedExit(basics.Lobby, castle, key)
+	basics.AddExit(basics.Lobby, beach)
+	shell := basics.AddItem(beach, "shell")
+
+	joe := basics.AddPlayer("joe", basics.Lobby)
+	basics.sessions["joe"] = &Session{playerID: joe.ID}
+	call := func(obj *Object, method string, args ...string) error {
+		return handleGameEvent(basics, &GameEvent{sessionID: "joe", objectID: obj.ID, method: method, args: args})
+	}
+
+	// can't walk through a locked exit, or call internal methods
+	assert.True(t, errors.Is(call(gate, "Go"), ErrNotAllowed))
+	assert.True(t, errors.Is(call(gate, "getDestination"), ErrNotAllowed))
+	assert.Equal(t, basics.Lobby, joe.Parent())
+
+	// or interact with things in other rooms
+	assert.True(t, errors.Is(call(shell, "Take"), ErrNotAllowed))
+
+	assert.Nil(t, call(basics.Lobby.Children()[1], "Go"))
+	assert.Equal(t, beach, joe.Parent())
+	assert.Nil(t, call(shell, "Take"))
+	assert.Equal(t, joe, shell.Parent())
+
+	// the panel for the thing the player is focused on offers StopInspecting
+	assert.Nil(t, call(shell, "Inspect"))
+	assert.Nil(t, call(shell, "StopInspecting"))
+
+	// a method which panics is reported as an error instead of stopping the world
+	Bomb := basics.Item.Subclass("Bomb").AddMethod("getActions", func() []interface{} {
+		return []interface{}{"Explode"}
+	}).AddMethod("Explode", func() {
+		panic("boom")
+	})
+	bomb := basics.World.AddObject(beach, Bomb).Set("name", "bomb")
+	err := call(bomb, "Explode")
+	assert.True(t, errors.Is(err, ErrPanicked))
+	assert.Contains(t, err.Error(), "boom")
+
+	// even when it's one which builds the player's view
+	Dud := basics.Item.Subclass("Dud").AddMethod("getName", func() string {
+		panic("fizz")
+	})
+	basics.World.AddObject(beach, Dud)
+	err = call(shell, "Inspect")
+	assert.True(t, errors.Is(err, ErrPanicked))
+}
+
+func TestGiveAction(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	joe := basics.AddPlayer("joe", basics.Lobby)
+	ann := basics.AddPlayer("ann", basics.Lobby)
+	shell := basics.AddItem(joe, "shell")
+	basics.sessions["joe"] = &Session{playerID: joe.ID}
+
+	// the client sends back the arguments which came with the action
+	var give *Action
+	for _, section := range basics.World.GetView(joe.ID).Sections {
+		for _, block := range section.Content {
+			for _, action := range block.Actions {
+				if action.Label == "Give" {
+					give = action
+				}
+			}
+		}
+	}
+	assert.Equal(t, "Give to ann", give.Text)
+
+	// and can only give things to the players it was offered
+	bob := basics.AddPlayer("bob", basics.AddRoom("Attic"))
+	for _, args := range [][]string{{strconv.Itoa(bob.ID)}, {}, append(give.Args, "extra")} {
+		err := handleGameEvent(basics, &GameEvent{sessionID: "joe", objectID: shell.ID, method: give.Label, args: args})
+		assert.True(t, errors.Is(err, ErrNotAllowed), args)
+	}
+	assert.Equal(t, joe, shell.Parent())
+
+	assert.Nil(t, handleGameEvent(basics, &GameEvent{sessionID: "joe", objectID: shell.ID, method: give.Label, args: give.Args}))
+	assert.Equal(t, ann, shell.Parent())
+}
+
+func TestNamingFlow(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	basics.AddPlayer("Joe", basics.Lobby)
+	basics.AddPlayer("", basics.Lobby).Set("name", 5)
+
+	playerIDChan := make(chan int, 1)
+	handleNewPlayerEvent(basics, &NewPlayerEvent{sessionID: "s1", playerIDChan: playerIDChan})
+	player := basics.World.GetObject(<-playerIDChan)
+
+	view := basics.World.GetView(player.ID)
+	assert.NotNil(t, view.Lobby)
+	assert.Equal(t, 0, len(view.Content))
+
+	for _, name := range []string{"", "   ", "<script>", "a name which is much too long to fit", "joe"} {
+		err := handleSetNameEvent(basics, &SetNameEvent{sessionID: "s1", name: name})
+		assert.NotNil(t, err, "name: %q", name)
+	}
+	assert.Equal(t, basics.Nowhere, player.Parent())
+	assert.NotNil(t, handleChatEvent(basics, &ChatEvent{sessionID: "s1", mode: "shout", text: "hello?"}))
+
+	assert.Nil(t, handleSetNameEvent(basics, &SetNameEvent{sessionID: "s1", name: " Zoë "}))
+	assert.Equal(t, "Zoë", player.Get("name"))
+	assert.Equal(t, basics.Lobby, player.Parent())
+	assert.Nil(t, basics.World.GetView(player.ID).Lobby)
+	assert.Nil(t, handleChatEvent(basics, &ChatEvent{sessionID: "s1", mode: "say", text: "hello"}))
+
+	// renaming doesn't send them back to the lobby
+	basics.World.Move(player, basics.Nowhere)
+	assert.Nil(t, handleSetNameEvent(basics, &SetNameEvent{sessionID: "s1", name: "Zoe"}))
+	assert.Equal(t, basics.Nowhere, player.Parent())
+}
+
+func TestEventLoopRunsTimers(t *testing.T) {
+	world := NewWorld()
+	clock := NewManualClock(time.Unix(0, 0))
+	world.Clock = clock
+	basics := NewWorldBasics(world)
+	lamp := basics.AddItem(basics.Lobby, "lamp").Set("lit", true)
+	basics.World.Scheduler.After(time.Minute, func(ctx *Context) {
+		lamp.Set("lit", false)
+	})
+
+	snapshots := make(chan *World)
+	go basics.eventLoop(func(snapshot *World) {
+		snapshots <- snapshot
+	}, func(sessionID string, err error) {})
+	defer close(basics.events)
+
+	clock.Advance(time.Minute)
+	snapshot := <-snapshots
+	assert.Equal(t, false, snapshot.GetObject(lamp.ID).Get("lit"))
+}
+
+func TestBuilderActions(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	basics.BuilderToken = "secret"
+
+	playerIDChan := make(chan int, 1)
+	handleNewPlayerEvent(basics, &NewPlayerEvent{sessionID: "s1", playerIDChan: playerIDChan})
+	player := basics.World.GetObject(<-playerIDChan)
+	assert.Nil(t, handleSetNameEvent(basics, &SetNameEvent{sessionID: "s1", name: "Alice"}))
+
+	// being a builder takes the token, rather than anything players choose themselves
+	isBuilder := func() bool {
+		builder, _ := player.GetBool("builder")
+		return builder
+	}
+	assert.NotNil(t, handleBuilderEvent(basics, &BuilderEvent{sessionID: "s1", token: "guess"}))
+	assert.False(t, isBuilder())
+	basics.BuilderToken = ""
+	assert.NotNil(t, handleBuilderEvent(basics, &BuilderEvent{sessionID: "s1", token: ""}))
+	assert.False(t, isBuilder())
+	basics.BuilderToken = "secret"
+	assert.Nil(t, handleBuilderEvent(basics, &BuilderEvent{sessionID: "s1", token: "secret"}))
+	assert.True(t, isBuilder())
+
+	// actions which need text from the player say what to ask for, and the
+	// client sends the answer as the argument
+	findAction := func(objectID int, method string) *Action {
+		for _, section := range basics.World.GetView(player.ID).Sections {
+			for _, block := range section.Content {
+				for _, action := range block.Actions {
+					if section.Name == "build" && *block.ID == strconv.Itoa(objectID) && action.Label == method {
+						return action
+					}
+				}
+			}
+		}
+		return nil
+	}
+	rename := findAction(basics.Lobby.ID, "Rename")
+	assert.Equal(t, "prompt", rename.Type)
+	assert.Equal(t, "New name", rename.Prompt)
+	broom := basics.AddItem(basics.Lobby, "broom")
+	assert.Equal(t, "call", findAction(broom.ID, "Destroy").Type)
+
+	call := func(method string, args ...string) error {
+		return handleGameEvent(basics, &GameEvent{sessionID: "s1", objectID: basics.Lobby.ID, method: method, args: args})
+	}
+	assert.Nil(t, call("Describe", "A great hall"))
+	assert.Equal(t, "A great hall", basics.Lobby.Get("description"))
+	assert.Nil(t, call("Dig", "Cellar"))
+	assert.Equal(t, "Cellar", objectLabel(&Context{World: basics.World}, basics.Lobby.Children()[len(basics.Lobby.Children())-1]))
+	assert.True(t, errors.Is(call("Dig"), ErrBadArity))
+
+	// world files find rooms by name, so they can't be shared or taken from the built in rooms
+	assert.NotNil(t, call("Dig", " Cellar "))
+	assert.NotNil(t, call("Dig", "nowhere"))
+	assert.NotNil(t, call("Rename", "Great hall"))
+	assert.Nil(t, call("Rename", "lobby"))
+
+	// the world file is shown to the builder, escaped so it's shown as it is
+	basics.Lobby.Set("description", "A <great> hall")
+	assert.Nil(t, call("Export"))
+	modal := player.Call(&Context{World: basics.World}, "getModal").(*Object)
+	assert.Contains(t, modal.Get("content"), "name: Cellar")
+	assert.Contains(t, modal.Get("content"), "A &lt;great&gt; hall")
+}
+
+func TestRemovedPlayer(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	joe := basics.AddPlayer("joe", basics.Lobby)
+	basics.sessions["joe"] = &Session{playerID: joe.ID}
+
+	_, err := basics.World.RemoveObject(joe, RemoveMode{})
+	assert.Nil(t, err)
+	assert.Equal(t, "You are no longer in this world", basics.World.GetView(joe.ID).Lobby.Prompt)
+
+	// their session goes too, so leaving doesn't trip over the missing player
+	basics.dropRemovedSessions()
+	assert.Nil(t, basics.sessions["joe"])
+	handleDisconnectedPlayerEvent(basics, &DisconnectedPlayerEvent{sessionID: "joe"})
+	assert.NotNil(t, handleChatEvent(basics, &ChatEvent{sessionID: "joe", mode: "say", text: "hi"}))
+}
+
+func TestLockedExitKeepsActions(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	castle := basics.AddRoom("Castle")
+	key := basics.AddItem(castle, "key")
+	gate := basics.AddLockedExit(basics.Lobby, castle, key)
+	ctx := &Context{World: basics.World}
+
+	// actions which aren't plain method names are kept when "Go" is filtered out
+	knock := &Action{Label: "Knock", Text: "Knock loudly"}
+	basics.Exit.AddMethod("getActions", func() []interface{} {
+		return []interface{}{"Go", knock}
+	})
+	assert.Equal(t, []interface{}{knock, "Unlock"}, gate.Call(ctx, "getActions"))
+}
+
+func TestRenderingSnapshots(t *testing.T) {
+	basics := NewWorldBasics(NewWorld())
+	joe := basics.AddPlayer("joe", basics.Lobby)
+	basics.Lobby.SetScript("getDescription", nil, `
+		self.views = 1
+		return "A grand lobby"
+	`)
+
+	// snapshots are shared by everyone rendering a view, so nothing can change them
+	snapshot := basics.World.Snapshot()
+	err := snapshot.GetObject(joe.ID).TrySet("name", "joseph")
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.Panics(t, func() { snapshot.Move(snapshot.GetObject(joe.ID), snapshot.GetObject(basics.Nowhere.ID)) })
+
+	// and a view which tries to is skipped rather than stopping the client
+	_, ok := renderView(&PlayerSnapshot{snapshot: snapshot, playerID: joe.ID})
+	assert.False(t, ok)
+	assert.Nil(t, basics.Lobby.Get("views"))
+	basics.Lobby.SetScript("getDescription", nil, `return "A grand lobby"`)
+	view, ok := renderView(&PlayerSnapshot{snapshot: basics.World.Snapshot(), playerID: joe.ID})
+	assert.True(t, ok)
+	assert.Equal(t, "A grand lobby", view.Content[0].Text)
+}
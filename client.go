@@ -7,19 +7,50 @@ import (
 type PlayerSnapshot struct {
 	playerID int
 	snapshot *World
+	// if set, the client is sent the full view instead of a diff
+	resync bool
 }
 
 type Client struct {
-	ID           int
-	sessionID    string
-	worldID      string
-	universe     *Universe
-	conn         *websocket.Conn
-	send         chan []byte
+	ID        int
+	sessionID string
+	worldID   string
+	universe  *Universe
+	conn      *websocket.Conn
+	send      chan []byte
+	// holds the latest snapshot the client hasn't rendered yet. Use sendSnapshot
+	// to write to it, so the universe never waits on a slow client.
 	snapshotChan chan *PlayerSnapshot
 	playerID     int
 }
 
+// sendSnapshot gives the client a snapshot to render, replacing any it hasn't
+// got to yet since only the latest state of the world matters. snapshotChan
+// must have room for one snapshot.
+func (client *Client) sendSnapshot(snapshot *PlayerSnapshot) {
+	for {
+		select {
+		case client.snapshotChan <- snapshot:
+			return
+		case old := <-client.snapshotChan:
+			// a resync which was replaced still needs doing
+			snapshot.resync = snapshot.resync || old.resync
+		}
+	}
+}
+
+// ClientSession tracks the player bound to a session and how many clients
+// (browser tabs) currently have it open
+type ClientSession struct {
+	playerID    int
+	clientCount int
+}
+
+type sessionKey struct {
+	worldID   string
+	sessionID string
+}
+
 type NewClientEvent struct {
 	client *Client
 }
@@ -37,3 +68,9 @@ type NewSnapshotEvent struct {
 	snapshot *World
 	worldID  string
 }
+
+type PlayerErrorEvent struct {
+	worldID   string
+	sessionID string
+	err       error
+}
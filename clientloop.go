@@ -4,11 +4,23 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
 )
 
+// Action is something a player can do to an object. Label is the name of the
+// method it calls. Type is "call" to call it with Args, or "prompt" to first ask
+// the player for some text with Prompt and pass it after Args.
 type Action struct {
-	Type     string
-	Label    string
+	Type  string
+	Label string
+	// what to ask the player for, when Type is "prompt"
+	Prompt string `json:",omitempty"`
+	// shown instead of Label, for actions which only differ in their arguments
+	Text string `json:",omitempty"`
+	// passed to the method when the action is used
+	Args     []string `json:",omitempty"`
 	objectID string
 }
 
@@ -19,10 +31,12 @@ type Block struct {
 	Actions []*Action
 }
 
+// FormRow is one question of a form, along with the player's latest guess and
+// whether it was right. The answer itself never leaves the server.
 type FormRow struct {
-	caption string
-	guess   string
-	correct bool
+	Caption string
+	Guess   string
+	Correct bool
 }
 
 type FormView struct {
@@ -37,16 +51,68 @@ type ModalView struct {
 	Form     *FormView
 	URL      *string
 	HTML     *string
-	showDone bool
+	ShowDone bool
+}
+
+// Section is a titled group of blocks shown alongside the main content, such as
+// the list of exits from a room
+type Section struct {
+	Name    string
+	Title   string
+	Content []*Block
+}
+
+// LobbyView is shown instead of a room to players who haven't chosen a name yet
+type LobbyView struct {
+	Prompt string
 }
 
 type View struct {
-	Content       []*Block
-	Modal         *ModalView
+	Lobby    *LobbyView
+	Content  []*Block
+	Sections []*Section
+	Modal    *ModalView
+	// the video mode of the player's room, and the conference they're in
 	JitsiMode     *string
+	JitsiRoom     *string
 	TimeRemaining float64
 }
 
+// HasAction returns true if the view contains a block for the given object which
+// offers method as an action that can be called with args. Call actions must be
+// used with exactly their Args, while prompts add whatever the player typed to
+// the end of theirs.
+func (v *View) HasAction(objectID int, method string, args []string) bool {
+	ID := strconv.Itoa(objectID)
+	blocks := append([]*Block{}, v.Content...)
+	for _, section := range v.Sections {
+		blocks = append(blocks, section.Content...)
+	}
+	for _, block := range blocks {
+		if block.ID == nil || *block.ID != ID {
+			continue
+		}
+		for _, action := range block.Actions {
+			if action.Label == method && action.allowsArgs(args) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Action) allowsArgs(args []string) bool {
+	if len(args) < len(a.Args) || (a.Type == "call" && len(args) != len(a.Args)) {
+		return false
+	}
+	for i := range a.Args {
+		if args[i] != a.Args[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // export interface NormalGameView extends GameView {
 // 	content: Array<Block>;
 // 	modal?: ModalView;
@@ -64,17 +130,56 @@ type View struct {
 // 	tiles?: Array<Array<string>>;
 //   }
 
+// Diff computes what needs to be sent to a client that is currently showing v so
+// that it ends up showing newView. If v is nil the client has nothing (or needs
+// a resync) and the full view is sent. Otherwise the result is an RFC 6902 JSON
+// Patch against v, or nil if nothing changed.
 func (v *View) Diff(newView *View) *Diff {
+	if v == nil {
+		return FullDiff(newView)
+	}
+
+	ops := computePatch("", toGeneric(v), toGeneric(newView))
+	if len(ops) == 0 {
+		return nil
+	}
+
 	buf := bytes.NewBuffer(nil)
-	err := json.NewEncoder(buf).Encode(newView)
+	err := json.NewEncoder(buf).Encode(ops)
 	if err != nil {
 		panic(fmt.Sprintf("error encoding json: %v", err))
 	}
 	return &Diff{JSON: buf.String()}
 }
 
+// FullDiff encodes the entire view. Used for the first message to a client and
+// whenever it asks to be resynced.
+func FullDiff(view *View) *Diff {
+	buf := bytes.NewBuffer(nil)
+	err := json.NewEncoder(buf).Encode(view)
+	if err != nil {
+		panic(fmt.Sprintf("error encoding json: %v", err))
+	}
+	return &Diff{JSON: buf.String(), Full: true}
+}
+
 type Diff struct {
+	// either a full View (if Full is set) or a JSON Patch to apply to the previous one
 	JSON string
+	Full bool
+}
+
+// renderView gets the player's view of a snapshot. Methods which build views can
+// be overridden by scripts, so a broken one is logged and the snapshot skipped,
+// rather than taking down the server.
+func renderView(snapshot *PlayerSnapshot) (view *View, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Rendering the view of player %d panicked: %v\n%s", snapshot.playerID, r, debug.Stack())
+			ok = false
+		}
+	}()
+	return snapshot.snapshot.GetView(snapshot.playerID), true
 }
 
 func ClientNotificationLoop(sessionID string, snapshotChan chan *PlayerSnapshot, send func(*Diff) bool) {
@@ -84,7 +189,13 @@ func ClientNotificationLoop(sessionID string, snapshotChan chan *PlayerSnapshot,
 		if !ok {
 			break
 		}
-		view := snapshot.snapshot.GetView(snapshot.playerID)
+		if snapshot.resync {
+			prevView = nil
+		}
+		view, ok := renderView(snapshot)
+		if !ok {
+			continue
+		}
 		diff := prevView.Diff(view)
 		if diff != nil {
 			ok = send(diff)
@@ -92,5 +203,6 @@ func ClientNotificationLoop(sessionID string, snapshotChan chan *PlayerSnapshot,
 				break
 			}
 		}
+		prevView = view
 	}
 }
@@ -0,0 +1,61 @@
+package muddy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// ConferenceNamer decides which video conference the players in a room join.
+// The name must be the same every time it's asked about the same room, so that
+// everyone in the room ends up in the same conference.
+type ConferenceNamer interface {
+	ConferenceName(worldID string, roomID int) string
+}
+
+// JitsiNamer names conferences on a shared Jitsi server. World IDs are in every
+// player's URL, so names are hashed with Secret to stop anyone who doesn't know
+// it from working out the name of a world's conferences. An empty Secret gives
+// names that anyone can work out.
+type JitsiNamer struct {
+	Prefix string
+	Secret string
+}
+
+func (n *JitsiNamer) ConferenceName(worldID string, roomID int) string {
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	fmt.Fprintf(mac, "%s/%d", worldID, roomID)
+	return n.Prefix + hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// DefaultConferenceNamer uses a secret chosen when the server starts. Worlds
+// only last as long as the server, so their conference names don't need to either.
+var DefaultConferenceNamer ConferenceNamer = &JitsiNamer{Prefix: "muddy-", Secret: newConferenceSecret()}
+
+func newConferenceSecret() string {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("can't choose a conference secret: %v", err))
+	}
+	return hex.EncodeToString(secret)
+}
+
+// the video modes a room can be in. Players in a room which isn't "off" join its conference.
+const (
+	VideoOff   = "off"
+	VideoAudio = "audio"
+	VideoVideo = "video"
+)
+
+// conference returns the video mode of a room and the name of its conference,
+// or nils if the room doesn't have one
+func (w *World) conference(room *Object) (*string, *string) {
+	mode, err := room.GetString("videoMode")
+	if err != nil || mode == VideoOff {
+		return nil, nil
+	}
+	name := w.Conferences.ConferenceName(w.ID, room.ID)
+	return &mode, &name
+}
@@ -1,7 +1,11 @@
 package muddy_test
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/pgm/muddy"
@@ -55,16 +59,29 @@ func (s *Simulator) setPlayer(player *muddy.Object) {
 	s.ctx = &muddy.Context{Player: player}
 }
 
+func viewContainsObject(view *muddy.View, obj *muddy.Object) bool {
+	blocks := append([]*muddy.Block{}, view.Content...)
+	for _, section := range view.Sections {
+		blocks = append(blocks, section.Content...)
+	}
+	for _, block := range blocks {
+		if block.ID != nil && *block.ID == strconv.Itoa(obj.ID) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Simulator) assertViewContainsObject(view *muddy.View, obj *muddy.Object) {
-	log.Printf("Warning: assertViewContainsObject unimplemented")
+	assert.True(s.t, viewContainsObject(view, obj), "object %d is not in the view", obj.ID)
 }
 
 func (s *Simulator) useExit(dest *muddy.Object) {
-	curRoom := s.ctx.Player.Parent
+	curRoom := s.ctx.Player.Parent()
 	// find the exit that corresponds to this destination
-	exits := muddy.FilterByClass(curRoom.Children, muddy.ExitClassName)
+	exits := muddy.FilterByClass(curRoom.Children(), muddy.ExitClassName)
 	for _, exit := range exits {
-		if exit.Get("destinationID") == dest.ID {
+		if exit.Get("destination") == dest {
 			s.exec(exit, "Go")
 			return
 		}
@@ -103,3 +120,762 @@ func TestGamePlay(t *testing.T) {
 	sim.useExit(tiny.Castle)
 	sim.useExit(tiny.Beach)
 }
+
+func TestDescriptionMarkup(t *testing.T) {
+	world := muddy.NewWorld()
+	basic := muddy.NewWorldBasics(world)
+
+	kitchen := basic.AddRoom("Kitchen").Set("description", "A [fork] lies on the [table polished table] next to a [spoon].")
+	fork := basic.AddItem(kitchen, "fork")
+	basic.AddItem(kitchen, "table")
+	joe := basic.AddPlayer("joe", kitchen)
+
+	view := world.GetView(joe.ID)
+	assert.Equal(t, 7, len(view.Content))
+
+	assert.Equal(t, "text", view.Content[0].Type)
+	assert.Equal(t, "A ", view.Content[0].Text)
+
+	assert.Equal(t, "object", view.Content[1].Type)
+	assert.Equal(t, "fork", view.Content[1].Text)
+	assert.Equal(t, strconv.Itoa(fork.ID), *view.Content[1].ID)
+	assert.Equal(t, 2, len(view.Content[1].Actions))
+	assert.Equal(t, "Take", view.Content[1].Actions[0].Label)
+
+	assert.Equal(t, "object", view.Content[3].Type)
+	assert.Equal(t, "polished table", view.Content[3].Text)
+
+	// spoon isn't in the room, so it's rendered as plain text
+	assert.Equal(t, "text", view.Content[5].Type)
+	assert.Equal(t, "spoon", view.Content[5].Text)
+	assert.Equal(t, ".", view.Content[6].Text)
+}
+
+func TestViewDiff(t *testing.T) {
+	var prev *muddy.View
+	view := &muddy.View{Content: []*muddy.Block{muddy.NewTextBlock("A big cave")}}
+
+	// with nothing to diff against, the whole view is sent
+	full := prev.Diff(view)
+	assert.True(t, full.Full)
+	assert.Equal(t, muddy.FullDiff(view).JSON, full.JSON)
+
+	same := &muddy.View{Content: []*muddy.Block{muddy.NewTextBlock("A big cave")}}
+	assert.Nil(t, view.Diff(same))
+
+	changed := &muddy.View{Content: []*muddy.Block{muddy.NewTextBlock("A small cave"), muddy.NewTextBlock("!")}}
+	diff := view.Diff(changed)
+	assert.False(t, diff.Full)
+
+	var ops []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(diff.JSON), &ops))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "replace", "path": "/Content/0/Text", "value": "A small cave"},
+		{"op": "add", "path": "/Content/-", "value": map[string]interface{}{"Type": "text", "Text": "!", "ID": nil, "Actions": nil}},
+	}, ops)
+
+	diff = changed.Diff(view)
+	ops = nil
+	assert.Nil(t, json.Unmarshal([]byte(diff.JSON), &ops))
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "replace", "path": "/Content/0/Text", "value": "A big cave"},
+		{"op": "remove", "path": "/Content/1"},
+	}, ops)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	tiny := NewTinyland(basic)
+	basic.AddItem(tiny.Beach, "shell").Set("weight", 2).Set("tags", []interface{}{"small", 1, true, 1.5, nil})
+	joe := basic.AddPlayer("joe", tiny.Beach)
+
+	data, err := basic.World.MarshalSnapshot()
+	assert.Nil(t, err)
+
+	restored := muddy.NewWorldBasics(muddy.NewWorld())
+	assert.Nil(t, restored.UnmarshalSnapshot(data))
+
+	again, err := restored.World.MarshalSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	restoredJoe := restored.World.GetObject(joe.ID)
+	assert.True(t, restoredJoe.IsInstanceOf(muddy.PlayerClassName))
+	assert.Equal(t, tiny.Beach.ID, restoredJoe.Parent().ID)
+	assert.Equal(t, len(tiny.Beach.Children()), len(restoredJoe.Parent().Children()))
+	for i, child := range tiny.Beach.Children() {
+		assert.Equal(t, child.ID, restoredJoe.Parent().Children()[i].ID)
+	}
+	shell := restoredJoe.Parent().Children()[1]
+	assert.Equal(t, 2, shell.Get("weight"))
+	assert.Equal(t, []interface{}{"small", 1, true, 1.5, nil}, shell.Get("tags"))
+
+	// methods are bound to the restored world's classes
+	assert.Equal(t, "joe", restoredJoe.Call(&muddy.Context{}, "getName"))
+}
+
+func TestSnapshotUnknownClass(t *testing.T) {
+	world := muddy.NewWorld()
+	Rock := world.RegisterClass(world.ObjectClass.Subclass("Rock"))
+	world.AddObject(nil, Rock)
+
+	data, err := world.MarshalSnapshot()
+	assert.Nil(t, err)
+
+	err = muddy.NewWorld().UnmarshalSnapshot(data)
+	assert.NotNil(t, err)
+
+	// objects whose class was never registered can't be saved
+	world.AddObject(nil, world.ObjectClass.Subclass("Pebble"))
+	_, err = world.MarshalSnapshot()
+	assert.NotNil(t, err)
+}
+
+func TestCallErrors(t *testing.T) {
+	world := muddy.NewWorld()
+	Counter := world.ObjectClass.Subclass("Counter").AddMethod("add", func(obj *muddy.Object, amount int) int {
+		return obj.Get("count").(int) + amount
+	})
+	counter := world.AddObject(nil, Counter).Set("count", 1)
+	ctx := &muddy.Context{}
+
+	result, err := counter.TryCall(ctx, "add", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result)
+
+	_, err = counter.TryCall(ctx, "nope")
+	assert.True(t, errors.Is(err, muddy.ErrNoSuchMethod))
+
+	_, err = counter.TryCall(ctx, "add", 1, 2)
+	assert.True(t, errors.Is(err, muddy.ErrBadArity))
+	assert.Contains(t, err.Error(), "\"add\" on class \"Counter\"")
+}
+
+func TestSuperclass(t *testing.T) {
+	world := muddy.NewWorld()
+
+	Animal := world.ObjectClass.Subclass("Animal").AddMethod("speak", func() string {
+		return "..."
+	})
+	var Dog *muddy.ClassDef
+	Dog = Animal.Subclass("Dog").AddMethod("speak", func(obj *muddy.Object, ctx *muddy.Context) string {
+		return Dog.CallSuper("speak", obj, ctx).(string) + "woof"
+	})
+	Puppy := Dog.Subclass("Puppy")
+
+	ctx := &muddy.Context{}
+	puppy := world.AddObject(nil, Puppy)
+	// the super call is relative to the class which defined the override, not the object's class
+	assert.Equal(t, "...woof", puppy.Call(ctx, "speak"))
+
+	assert.Equal(t, Dog, Puppy.Superclass())
+	assert.Equal(t, []*muddy.ClassDef{Dog, Animal, world.ObjectClass}, Puppy.Ancestors())
+	assert.Nil(t, world.ObjectClass.Superclass())
+
+	_, err := world.ObjectClass.TryCallSuper("speak", puppy, ctx)
+	assert.True(t, errors.Is(err, muddy.ErrNoSuchMethod))
+}
+
+func TestTypedProperties(t *testing.T) {
+	world := muddy.NewWorld()
+	Lamp := world.ObjectClass.Subclass("Lamp").
+		AddTypedProperty("brightness", muddy.IntType, 5, muddy.IntRange(0, 10)).
+		AddTypedProperty("color", muddy.StringType, "white", muddy.OneOf("white", "red")).
+		AddTypedProperty("owner", muddy.ObjectRefType, nil).
+		AddProperty("anything", 1)
+	lamp := world.AddObject(nil, Lamp)
+
+	assert.Nil(t, lamp.TrySet("brightness", 7))
+	assert.True(t, errors.Is(lamp.TrySet("brightness", "bright"), muddy.ErrWrongType))
+	assert.True(t, errors.Is(lamp.TrySet("brightness", 11), muddy.ErrConstraint))
+	assert.True(t, errors.Is(lamp.TrySet("color", "blue"), muddy.ErrConstraint))
+	assert.Nil(t, lamp.TrySet("owner", lamp))
+	assert.Nil(t, lamp.TrySet("anything", "goes"))
+	assert.Panics(t, func() { lamp.Set("brightness", -1) })
+
+	brightness, err := lamp.GetInt("brightness")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, brightness)
+
+	owner, err := lamp.GetRef("owner")
+	assert.Nil(t, err)
+	assert.Equal(t, lamp, owner)
+
+	_, err = lamp.GetString("brightness")
+	assert.True(t, errors.Is(err, muddy.ErrWrongType))
+	_, err = lamp.GetBool("missing")
+	assert.True(t, errors.Is(err, muddy.ErrNoSuchProperty))
+	assert.NotNil(t, lamp.TryAppend("color", "red"))
+
+	// schemas are inherited
+	FancyLamp := Lamp.Subclass("FancyLamp")
+	assert.Equal(t, muddy.IntType, FancyLamp.PropertySchema("brightness").Type)
+	assert.Panics(t, func() { FancyLamp.AddProperty("brightness", 100) })
+}
+
+func TestArgumentCoercion(t *testing.T) {
+	world := muddy.NewWorld()
+	var received []interface{}
+	Machine := world.ObjectClass.Subclass("Machine").AddMethod("configure", func(obj *muddy.Object, ctx *muddy.Context, count int, enabled bool, ratio float64, target *muddy.Object) {
+		received = []interface{}{count, enabled, ratio, target}
+	})
+	machine := world.AddObject(nil, Machine)
+	ctx := &muddy.Context{World: world}
+
+	_, err := machine.TryCall(ctx, "configure", "3", "true", "0.5", strconv.Itoa(machine.ID))
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3, true, 0.5, machine}, received)
+
+	// values which are already the right type are passed through
+	_, err = machine.TryCall(ctx, "configure", 4, false, 1.5, machine)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{4, false, 1.5, machine}, received)
+
+	for _, args := range [][]interface{}{
+		{"three", "true", "0.5", "1"},
+		{"3", "yes please", "0.5", "1"},
+		{"3", "true", "half", "1"},
+		{"3", "true", "0.5", "999"},
+		{"3", "true", "0.5", "fork"},
+	} {
+		_, err = machine.TryCall(ctx, "configure", args...)
+		assert.True(t, errors.Is(err, muddy.ErrBadArgument), "args: %v", args)
+	}
+}
+
+func TestObjectRefs(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	tiny := NewTinyland(basic)
+	key := basic.AddItem(tiny.Beach, "key").Set("opens", tiny.Castle).Set("history", []interface{}{tiny.Beach, "found"})
+
+	assert.Equal(t, tiny.Castle, key.Get("opens"))
+	assert.Equal(t, []interface{}{tiny.Beach, "found"}, key.Get("history"))
+
+	// after cloning, references resolve to objects in the clone
+	clone := basic.World.Clone()
+	clonedKey := clone.GetObject(key.ID)
+	clonedCastle := clonedKey.Get("opens").(*muddy.Object)
+	assert.Equal(t, tiny.Castle.ID, clonedCastle.ID)
+	assert.True(t, clonedCastle == clone.GetObject(tiny.Castle.ID))
+	assert.False(t, clonedCastle == tiny.Castle)
+
+	// references survive a snapshot
+	data, err := basic.World.MarshalSnapshot()
+	assert.Nil(t, err)
+	restored := muddy.NewWorldBasics(muddy.NewWorld())
+	assert.Nil(t, restored.UnmarshalSnapshot(data))
+	assert.Equal(t, tiny.Castle.ID, restored.World.GetObject(key.ID).Get("opens").(*muddy.Object).ID)
+
+	// a reference to an object which isn't in the world
+	elsewhere := muddy.NewWorld()
+	for i := 0; i < 100; i++ {
+		elsewhere.AddObject(nil, elsewhere.ObjectClass)
+	}
+	ghost := elsewhere.GetObject(100)
+	key.Set("opens", ghost).Append("history", ghost)
+
+	assert.Nil(t, key.Get("opens"))
+	_, err = key.GetRef("opens")
+	assert.True(t, errors.Is(err, muddy.ErrDanglingReference))
+
+	dangling := basic.World.FindDanglingReferences()
+	assert.Equal(t, []*muddy.DanglingReference{
+		{ObjectID: key.ID, Property: "history", TargetID: 100},
+		{ObjectID: key.ID, Property: "opens", TargetID: 100},
+	}, dangling)
+
+	assert.Equal(t, dangling, basic.World.ClearDanglingReferences())
+	assert.Equal(t, 0, len(basic.World.FindDanglingReferences()))
+	assert.Nil(t, key.Get("opens"))
+	assert.Equal(t, []interface{}{tiny.Beach, "found"}, key.Get("history"))
+}
+
+func TestNestedValues(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	tiny := NewTinyland(basic)
+	box := basic.AddItem(tiny.Beach, "box")
+
+	// lists can hold values which can't be compared, including other lists
+	box.Set("lists", []interface{}{[]interface{}{"a", tiny.Castle}, []interface{}{}})
+	box.Set("maps", []interface{}{map[string]interface{}{"a": 1}})
+	box.Set("slices", []interface{}{[]string{"a"}, tiny.Beach})
+
+	assert.Equal(t, []interface{}{[]interface{}{"a", tiny.Castle}, []interface{}{}}, box.Get("lists"))
+	assert.Equal(t, []interface{}{map[string]interface{}{"a": 1}}, box.Get("maps"))
+	assert.Equal(t, []interface{}{[]string{"a"}, tiny.Beach}, box.Get("slices"))
+}
+
+func TestRemoveObject(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+
+	chest := basic.AddItem(tiny.Beach, "chest")
+	coin := basic.AddItem(chest, "coin")
+	map_ := basic.AddItem(tiny.Castle, "map").Set("marks", chest).Set("treasure", []interface{}{coin, "gold"})
+
+	// remove the chest, but keep what was inside
+	refs, err := world.RemoveObject(chest, muddy.MoveChildrenTo(basic.Nowhere))
+	assert.Nil(t, err)
+	assert.Equal(t, []*muddy.DanglingReference{{ObjectID: map_.ID, Property: "marks", TargetID: chest.ID}}, refs)
+	assert.Nil(t, world.GetObject(chest.ID))
+	assert.Equal(t, basic.Nowhere, coin.Parent())
+	assert.False(t, containsObject(tiny.Beach.Children(), chest))
+	assert.Nil(t, map_.Get("marks"))
+
+	// remove the map with everything in it, leaving references to it in place
+	crumb := basic.AddItem(map_, "crumb")
+	basic.AddItem(tiny.Beach, "note").Set("about", crumb)
+	refs, err = world.RemoveObject(map_, muddy.RemoveMode{KeepReferences: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(refs))
+	assert.Nil(t, world.GetObject(crumb.ID))
+	assert.Equal(t, 1, len(world.FindDanglingReferences()))
+
+	// consumed items go away entirely
+	refs, err = world.RemoveObject(coin, muddy.RemoveSubtree)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(refs))
+	assert.Equal(t, 0, len(basic.Nowhere.Children()))
+
+	// can't remove something twice, or move children into the subtree being removed
+	_, err = world.RemoveObject(coin, muddy.RemoveSubtree)
+	assert.NotNil(t, err)
+	box := basic.AddItem(tiny.Beach, "box")
+	inner := basic.AddItem(box, "inner box")
+	_, err = world.RemoveObject(box, muddy.MoveChildrenTo(inner))
+	assert.NotNil(t, err)
+}
+
+func containsObject(list []*muddy.Object, obj *muddy.Object) bool {
+	for _, element := range list {
+		if element == obj {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Beach)
+
+	snapshot := basic.World.Clone()
+
+	// changes to the original aren't visible in the snapshot...
+	joe.Set("name", "joseph")
+	basic.World.Move(joe, tiny.Castle)
+	basic.AddItem(tiny.Beach, "shell")
+
+	snapJoe := snapshot.GetObject(joe.ID)
+	assert.Equal(t, "joe", snapJoe.Get("name"))
+	assert.Equal(t, tiny.Beach.ID, snapJoe.Parent().ID)
+	// the beach has its exit, and joe in the snapshot but the shell in the original
+	assert.Equal(t, joe.ID, snapshot.GetObject(tiny.Beach.ID).Children()[1].ID)
+	assert.Equal(t, "shell", tiny.Beach.Children()[1].Get("name"))
+
+	// ...and vice versa
+	snapJoe.Set("name", "jo")
+	assert.Equal(t, "joseph", joe.Get("name"))
+	assert.Equal(t, tiny.Castle, joe.Parent())
+
+	// each world has one handle per object
+	assert.True(t, snapJoe == snapshot.GetObject(joe.ID))
+}
+
+// build a world of the given size, and then time how long it takes to make a
+// change and snapshot it. This should depend on the number of changes, not on
+// the size of the world.
+func benchmarkSnapshot(b *testing.B, roomCount int, changesPerSnapshot int) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	rooms := make([]*muddy.Object, roomCount)
+	for i := range rooms {
+		rooms[i] = basic.AddRoom("room " + strconv.Itoa(i))
+		basic.AddItem(rooms[i], "rock")
+	}
+	joe := basic.AddPlayer("joe", rooms[0])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < changesPerSnapshot; j++ {
+			room := rooms[(i*changesPerSnapshot+j)%roomCount]
+			room.Set("visits", i)
+			basic.World.Move(joe, room)
+		}
+		basic.World.Clone()
+	}
+}
+
+func BenchmarkSnapshot100Objects1Change(b *testing.B)     { benchmarkSnapshot(b, 50, 1) }
+func BenchmarkSnapshot10kObjects1Change(b *testing.B)     { benchmarkSnapshot(b, 5000, 1) }
+func BenchmarkSnapshot100kObjects1Change(b *testing.B)    { benchmarkSnapshot(b, 50000, 1) }
+func BenchmarkSnapshot100kObjects10Changes(b *testing.B)  { benchmarkSnapshot(b, 50000, 10) }
+func BenchmarkSnapshot100kObjects100Changes(b *testing.B) { benchmarkSnapshot(b, 50000, 100) }
+
+func sectionLabels(view *muddy.View, name string) []string {
+	for _, section := range view.Sections {
+		if section.Name == name {
+			labels := make([]string, len(section.Content))
+			for i, block := range section.Content {
+				labels[i] = block.Text
+			}
+			return labels
+		}
+	}
+	return nil
+}
+
+func TestRoomView(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	tiny := NewTinyland(basic)
+	basic.AddItem(tiny.Castle, "sword")
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	basic.AddPlayer("ann", tiny.Castle)
+
+	view := basic.World.GetView(joe.ID)
+	assert.Equal(t, []string{"Beach", "Taco Stand"}, sectionLabels(view, "exits"))
+	assert.Equal(t, []string{"sword"}, sectionLabels(view, "contents"))
+	// joe doesn't see himself
+	assert.Equal(t, []string{"ann"}, sectionLabels(view, "players"))
+
+	exitBlock := view.Sections[0].Content[0]
+	assert.Equal(t, strconv.Itoa(tiny.Castle.Children()[0].ID), *exitBlock.ID)
+	assert.Equal(t, "Go", exitBlock.Actions[0].Label)
+
+	// rooms can override what's listed
+	Dark := basic.Room.Subclass("DarkRoom").AddMethod("getContents", func() []*muddy.Object {
+		return []*muddy.Object{}
+	})
+	cellar := basic.World.AddObject(nil, Dark).Set("name", "Cellar")
+	basic.AddItem(cellar, "spider")
+	basic.World.Move(joe, cellar)
+
+	view = basic.World.GetView(joe.ID)
+	assert.Equal(t, []string{}, sectionLabels(view, "contents"))
+}
+
+func TestInventory(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	shell := basic.AddItem(tiny.Beach, "shell")
+	joe := basic.AddPlayer("joe", tiny.Beach)
+	ann := basic.AddPlayer("ann", tiny.Beach)
+	bob := basic.AddPlayer("bob", tiny.Castle)
+	joeCtx := &muddy.Context{Player: joe, World: world}
+	annCtx := &muddy.Context{Player: ann, World: world}
+	bobCtx := &muddy.Context{Player: bob, World: world}
+
+	assert.Equal(t, []interface{}{"Take", "Inspect"}, shell.Call(joeCtx, "getActions"))
+	_, err := shell.TryCall(bobCtx, "Take")
+	assert.NotNil(t, err, "bob isn't on the beach")
+
+	_, err = shell.TryCall(joeCtx, "Take")
+	assert.Nil(t, err)
+	assert.Equal(t, joe, shell.Parent())
+	assert.Equal(t, []string{"shell"}, sectionLabels(world.GetView(joe.ID), "inventory"))
+	assert.Equal(t, []string{}, sectionLabels(world.GetView(joe.ID), "contents"))
+	giveToAnn := &muddy.Action{Label: "Give", Text: "Give to ann", Args: []string{strconv.Itoa(ann.ID)}}
+	assert.Equal(t, []interface{}{"Drop", giveToAnn, "Inspect"}, shell.Call(joeCtx, "getActions"))
+
+	// nobody can take things out of someone else's inventory
+	assert.Equal(t, []interface{}{}, shell.Call(annCtx, "getActions"))
+	_, err = shell.TryCall(annCtx, "Take")
+	assert.NotNil(t, err)
+	_, err = shell.TryCall(annCtx, "Drop")
+	assert.NotNil(t, err)
+
+	// only players in the same room can be given things. The recipient comes from the client as an ID.
+	_, err = shell.TryCall(joeCtx, "Give", strconv.Itoa(bob.ID))
+	assert.NotNil(t, err)
+	_, err = shell.TryCall(joeCtx, "Give", strconv.Itoa(tiny.Castle.ID))
+	assert.NotNil(t, err)
+	_, err = shell.TryCall(joeCtx, "Give", strconv.Itoa(ann.ID))
+	assert.Nil(t, err)
+	assert.Equal(t, ann, shell.Parent())
+
+	_, err = shell.TryCall(annCtx, "Drop")
+	assert.Nil(t, err)
+	assert.Equal(t, tiny.Beach, shell.Parent())
+	assert.Equal(t, []string{"shell"}, sectionLabels(world.GetView(joe.ID), "contents"))
+}
+
+func TestFocus(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	Machine := basic.Thing.Subclass("Machine").AddProperty("actions", []interface{}{"Inspect"})
+	machine := world.AddObject(tiny.Castle, Machine).Set("name", "machine").Set("description", "A humming machine with a [lever]")
+	lever := world.AddObject(machine, basic.Part).Set("name", "lever").Set("actions", []interface{}{"Pull"})
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ann := basic.AddPlayer("ann", tiny.Castle)
+	joeCtx := &muddy.Context{Player: joe, World: world}
+	annCtx := &muddy.Context{Player: ann, World: world}
+
+	assert.Nil(t, sectionLabels(world.GetView(joe.ID), "focus"))
+
+	machine.Call(joeCtx, "Inspect")
+	machine.Call(annCtx, "Inspect")
+	assert.Equal(t, machine, joe.Call(joeCtx, "getFocus"))
+	assert.Equal(t, []*muddy.Object{joe, ann}, machine.Call(joeCtx, "getWatching"))
+
+	view := world.GetView(joe.ID)
+	assert.Equal(t, []string{"machine", "A humming machine with a ", "lever", "Also looking: ann"}, sectionLabels(view, "focus"))
+	focus := view.Sections[len(view.Sections)-1]
+	assert.Equal(t, "StopInspecting", focus.Content[0].Actions[1].Label)
+	assert.Equal(t, strconv.Itoa(lever.ID), *focus.Content[2].ID)
+
+	// a change made by one watcher shows up in the other's panel
+	prev := world.GetView(ann.ID)
+	machine.Set("description", "A silent machine")
+	diff := prev.Diff(world.GetView(ann.ID))
+	assert.Contains(t, diff.JSON, "A silent machine")
+
+	machine.Call(annCtx, "StopInspecting")
+	assert.Equal(t, []*muddy.Object{joe}, machine.Call(joeCtx, "getWatching"))
+	assert.Nil(t, ann.Call(annCtx, "getFocus"))
+
+	// leaving the room clears the focus
+	exit := muddy.FilterByClass(tiny.Castle.Children(), muddy.ExitClassName)[0]
+	exit.Call(joeCtx, "Go")
+	assert.Nil(t, joe.Call(joeCtx, "getFocus"))
+	assert.Equal(t, []*muddy.Object{}, machine.Call(joeCtx, "getWatching"))
+}
+
+func TestLockedExit(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	key := basic.AddItem(tiny.Beach, "key")
+	gate := basic.AddLockedExit(tiny.Beach, tiny.TacoStand, key)
+	joe := basic.AddPlayer("joe", tiny.Beach)
+	ctx := &muddy.Context{Player: joe, World: world}
+
+	assert.Equal(t, []interface{}{"Unlock"}, gate.Call(ctx, "getActions"))
+	_, err := gate.TryCall(ctx, "Go")
+	assert.NotNil(t, err)
+	assert.Equal(t, tiny.Beach, joe.Parent())
+
+	// the key has to be in the player's inventory, not just in the room
+	_, err = gate.TryCall(ctx, "Unlock")
+	assert.NotNil(t, err)
+
+	key.Call(ctx, "Take")
+	assert.Nil(t, gate.Call(ctx, "Unlock"))
+	assert.Equal(t, []interface{}{"Go", "Lock"}, gate.Call(ctx, "getActions"))
+	assert.Nil(t, gate.Call(ctx, "Lock"))
+	assert.Equal(t, true, gate.Get("locked"))
+	assert.Nil(t, gate.Call(ctx, "Unlock"))
+
+	_, err = gate.TryCall(ctx, "Go")
+	assert.Nil(t, err)
+	assert.Equal(t, tiny.TacoStand, joe.Parent())
+}
+
+func TestChat(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ann := basic.AddPlayer("ann", tiny.Castle)
+	bob := basic.AddPlayer("bob", tiny.Beach)
+	joeCtx := &muddy.Context{Player: joe, World: world}
+
+	joe.Call(joeCtx, "say", " hello ")
+	assert.Equal(t, []string{"joe says: hello"}, sectionLabels(world.GetView(ann.ID), "messages"))
+	assert.Equal(t, []string{"joe says: hello"}, sectionLabels(world.GetView(joe.ID), "messages"))
+	assert.Equal(t, []string{}, sectionLabels(world.GetView(bob.ID), "messages"))
+
+	joe.Call(joeCtx, "shout", "anyone there?")
+	assert.Equal(t, []string{"joe shouts from Castle: anyone there?"}, sectionLabels(world.GetView(bob.ID), "messages"))
+	assert.Equal(t, "joe shouts: anyone there?", ann.Call(joeCtx, "getMessages").([]string)[1])
+
+	joe.Call(joeCtx, "whisper", ann, "psst")
+	assert.Equal(t, "joe whispers: psst", ann.Call(joeCtx, "getMessages").([]string)[2])
+	_, err := joe.TryCall(joeCtx, "whisper", bob, "psst")
+	assert.NotNil(t, err)
+	_, err = joe.TryCall(joeCtx, "say", "   ")
+	assert.NotNil(t, err)
+	_, err = joe.TryCall(joeCtx, "say", strings.Repeat("a", muddy.MaxChatMessageLength+1))
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, len(joe.Call(joeCtx, "getMessages").([]string)))
+
+	// once the scrollback is full, old lines are dropped, and the diff only
+	// carries the changes at each end rather than every line
+	for i := 0; i < muddy.MaxMessageLogLength; i++ {
+		joe.Call(joeCtx, "say", fmt.Sprintf("line %d", i))
+	}
+	messages := ann.Call(joeCtx, "getMessages").([]string)
+	assert.Equal(t, muddy.MaxMessageLogLength, len(messages))
+	assert.Equal(t, "joe says: line 0", messages[0])
+
+	prev := world.GetView(ann.ID)
+	joe.Call(joeCtx, "say", "one more")
+	diff := prev.Diff(world.GetView(ann.ID))
+	var ops []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(diff.JSON), &ops))
+	assert.Equal(t, 2, len(ops))
+	assert.Equal(t, "remove", ops[0]["op"])
+	assert.Equal(t, "add", ops[1]["op"])
+	assert.Contains(t, diff.JSON, "one more")
+}
+
+func TestPuzzleForm(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+	sphinx := basic.AddPuzzle(tiny.Castle, "sphinx", "The riddle of the sphinx",
+		[]string{"What walks on four legs in the morning?", "What is 6 times 7?"},
+		[]string{"Man", "42"})
+
+	assert.Nil(t, world.GetView(joe.ID).Modal)
+	_, err := joe.TryCall(ctx, "submitForm", sphinx, []string{"man", "42"})
+	assert.NotNil(t, err)
+
+	sphinx.Call(ctx, "Solve")
+	modal := joe.Call(ctx, "getModal").(*muddy.Object)
+	_, err = joe.TryCall(ctx, "submitForm", sphinx, []string{"man", "42"})
+	assert.NotNil(t, err)
+	view := world.GetView(joe.ID)
+	assert.Equal(t, "form", view.Modal.Type)
+	assert.Equal(t, strconv.Itoa(modal.ID), view.Modal.ID)
+	assert.Equal(t, "The riddle of the sphinx", view.Modal.Form.Title)
+	assert.Equal(t, 2, len(view.Modal.Form.Rows))
+	assert.Equal(t, "What is 6 times 7?", view.Modal.Form.Rows[1].Caption)
+	assert.False(t, view.Modal.Form.Rows[0].Correct)
+
+	// the answers never make it into what's sent to the client
+	assert.NotContains(t, muddy.FullDiff(view).JSON, "42")
+
+	_, err = joe.TryCall(ctx, "submitForm", modal, []string{"man"})
+	assert.NotNil(t, err)
+	joe.Call(ctx, "submitForm", modal, []string{" man ", "41"})
+	rows := world.GetView(joe.ID).Modal.Form.Rows
+	assert.Equal(t, " man ", rows[0].Guess)
+	assert.True(t, rows[0].Correct)
+	assert.False(t, rows[1].Correct)
+
+	joe.Call(ctx, "submitForm", modal, []string{"man", "42"})
+	assert.Nil(t, world.GetView(joe.ID).Modal)
+	assert.Equal(t, []string{"You solved sphinx!"}, joe.Call(ctx, "getMessages"))
+
+	// subclasses can decide what happens when a puzzle is solved
+	var Vault *muddy.ClassDef
+	Vault = basic.Puzzle.Subclass("Vault").AddMethod("onSolved", func(obj *muddy.Object, ctx *muddy.Context, player *muddy.Object) {
+		obj.Set("open", true)
+		Vault.CallSuper("onSolved", obj, ctx, player)
+	})
+	vault := world.AddObject(tiny.Castle, Vault).Set("questions", []interface{}{"Combination?"}).Set("answers", []interface{}{"1234"})
+	vault.Call(ctx, "Solve")
+	joe.Call(ctx, "submitForm", joe.Call(ctx, "getModal"), []string{"1234"})
+	assert.Equal(t, true, vault.Get("open"))
+	assert.Nil(t, world.GetView(joe.ID).Modal)
+
+	// a question without an answer can't be solved, but doesn't break the view
+	vault.Set("questions", []interface{}{"Combination?", "Password?"})
+	vault.Call(ctx, "Solve")
+	joe.Call(ctx, "submitForm", joe.Call(ctx, "getModal"), []string{"1234", "swordfish"})
+	rows = world.GetView(joe.ID).Modal.Form.Rows
+	assert.True(t, rows[0].Correct)
+	assert.False(t, rows[1].Correct)
+
+	// once the puzzle has gone, so has its form, and whatever is queued behind it is shown
+	poster := basic.AddItem(tiny.Castle, "poster")
+	joe.Call(ctx, "openModal", poster, "html", "<b>Wanted</b>", false)
+	_, err = world.RemoveObject(vault, muddy.RemoveSubtree)
+	assert.Nil(t, err)
+	assert.Equal(t, "html", world.GetView(joe.ID).Modal.Type)
+}
+
+func TestModals(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+
+	closed := make([]string, 0)
+	Poster := basic.Thing.Subclass("Poster").AddMethod("onModalClosed", func(obj *muddy.Object, player *muddy.Object, outcome string) {
+		closed = append(closed, obj.Get("name").(string)+" "+outcome)
+	})
+	poster := world.AddObject(tiny.Castle, Poster).Set("name", "poster")
+	chart := world.AddObject(tiny.Castle, Poster).Set("name", "map")
+
+	first := joe.Call(ctx, "openModal", poster, "html", "<b>Wanted</b>", true).(*muddy.Object)
+	view := world.GetView(joe.ID)
+	assert.Equal(t, "html", view.Modal.Type)
+	assert.Equal(t, "<b>Wanted</b>", *view.Modal.HTML)
+	assert.True(t, view.Modal.ShowDone)
+
+	// a modal from something else waits until the first one is closed
+	second := joe.Call(ctx, "openModal", chart, "url", "https://example.com/map.png", false).(*muddy.Object)
+	assert.Equal(t, strconv.Itoa(first.ID), world.GetView(joe.ID).Modal.ID)
+
+	// but one from the same thing replaces it where it is
+	replaced := joe.Call(ctx, "openModal", poster, "html", "<b>Reward</b>", true).(*muddy.Object)
+	assert.Equal(t, first, replaced)
+	assert.Equal(t, []*muddy.Object{first, second}, joe.Call(ctx, "getModals"))
+	assert.Equal(t, "<b>Reward</b>", *world.GetView(joe.ID).Modal.HTML)
+
+	_, err := joe.TryCall(ctx, "closeModal", first, "whatever")
+	assert.NotNil(t, err)
+	joe.Call(ctx, "closeModal", first, "done")
+	view = world.GetView(joe.ID)
+	assert.Equal(t, "https://example.com/map.png", *view.Modal.URL)
+
+	_, err = joe.TryCall(ctx, "closeModal", first, "done")
+	assert.NotNil(t, err)
+	joe.Call(ctx, "closeModal", second, "dismiss")
+	assert.Nil(t, world.GetView(joe.ID).Modal)
+	assert.Equal(t, []string{"poster done", "map dismiss"}, closed)
+}
+
+type stubConferences struct{}
+
+func (stubConferences) ConferenceName(worldID string, roomID int) string {
+	return fmt.Sprintf("%s/%d", worldID, roomID)
+}
+
+func TestConferences(t *testing.T) {
+	world := muddy.NewWorld()
+	world.ID = "w1"
+	world.Conferences = stubConferences{}
+	basic := muddy.NewWorldBasics(world)
+	tiny := NewTinyland(basic)
+	tiny.Castle.Set("videoMode", muddy.VideoVideo)
+	tiny.Beach.Set("videoMode", muddy.VideoAudio)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+
+	err := tiny.Castle.TrySet("videoMode", "hologram")
+	assert.True(t, errors.Is(err, muddy.ErrConstraint))
+
+	view := world.GetView(joe.ID)
+	assert.Equal(t, muddy.VideoVideo, *view.JitsiMode)
+	assert.Equal(t, fmt.Sprintf("w1/%d", tiny.Castle.ID), *view.JitsiRoom)
+
+	// walking to another room switches conference
+	world.Move(joe, tiny.Beach)
+	diff := view.Diff(world.GetView(joe.ID))
+	assert.Contains(t, diff.JSON, fmt.Sprintf("w1/%d", tiny.Beach.ID))
+	assert.Contains(t, diff.JSON, muddy.VideoAudio)
+
+	world.Move(joe, tiny.TacoStand)
+	view = world.GetView(joe.ID)
+	assert.Nil(t, view.JitsiMode)
+	assert.Nil(t, view.JitsiRoom)
+
+	// real names are stable, but differ between rooms and worlds
+	namer := &muddy.JitsiNamer{Prefix: "muddy-"}
+	assert.Equal(t, namer.ConferenceName("w1", 2), namer.ConferenceName("w1", 2))
+	assert.NotEqual(t, namer.ConferenceName("w1", 2), namer.ConferenceName("w1", 3))
+	assert.NotEqual(t, namer.ConferenceName("w1", 2), namer.ConferenceName("w2", 2))
+	assert.True(t, strings.HasPrefix(namer.ConferenceName("w1", 2), "muddy-"))
+
+	// and can't be worked out from the world's ID without the secret
+	namer.Secret = "hush"
+	other := &muddy.JitsiNamer{Prefix: "muddy-", Secret: "guess"}
+	assert.NotEqual(t, namer.ConferenceName("w1", 2), other.ConferenceName("w1", 2))
+}
@@ -0,0 +1,152 @@
+package muddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is a single operation of an RFC 6902 JSON Patch. Only the subset of
+// operations needed to transform one view into another is ever generated:
+// "add", "remove" and "replace".
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func (op *PatchOp) MarshalJSON() ([]byte, error) {
+	// "remove" is the only operation which must not carry a value. The others
+	// need it even when it's null.
+	if op.Op == "remove" {
+		return json.Marshal(map[string]string{"op": op.Op, "path": op.Path})
+	}
+	type plainPatchOp PatchOp
+	return json.Marshal((*plainPatchOp)(op))
+}
+
+// toGeneric round trips a value through JSON so that it can be compared
+// structurally as maps, slices and scalars.
+func toGeneric(value interface{}) interface{} {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		panic(fmt.Sprintf("error encoding json: %v", err))
+	}
+	var generic interface{}
+	err = json.Unmarshal(buf, &generic)
+	if err != nil {
+		panic(fmt.Sprintf("error decoding json: %v", err))
+	}
+	return generic
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// computePatch returns the operations which transform a into b. Both must be
+// values produced by toGeneric.
+func computePatch(path string, a interface{}, b interface{}) []*PatchOp {
+	return computeValuePatch(path, a, b, false)
+}
+
+// computeValuePatch is computePatch for a value within a view. scrollback is set
+// for the content of the messages section, which loses lines from the front as
+// new ones are added to the end.
+func computeValuePatch(path string, a interface{}, b interface{}, scrollback bool) []*PatchOp {
+	ops := make([]*PatchOp, 0)
+
+	switch aValue := a.(type) {
+	case map[string]interface{}:
+		bValue, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := sortedKeys(aValue, bValue)
+		for _, key := range keys {
+			childPath := path + "/" + escapePointer(key)
+			aChild, inA := aValue[key]
+			bChild, inB := bValue[key]
+			if !inB {
+				ops = append(ops, &PatchOp{Op: "remove", Path: childPath})
+			} else if !inA {
+				ops = append(ops, &PatchOp{Op: "add", Path: childPath, Value: bChild})
+			} else {
+				childScrollback := key == "Content" && aValue["Name"] == "messages" && bValue["Name"] == "messages"
+				ops = append(ops, computeValuePatch(childPath, aChild, bChild, childScrollback)...)
+			}
+		}
+		return ops
+	case []interface{}:
+		bValue, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		// when lines have been dropped from the front of a scrollback which is
+		// full, remove them rather than rewriting every element. Only done for the
+		// scrollback, since finding the shift takes time for every possible one.
+		shift := 0
+		if scrollback {
+			shift = shiftedBy(aValue, bValue)
+		}
+		if shift > 0 {
+			for i := 0; i < shift; i++ {
+				ops = append(ops, &PatchOp{Op: "remove", Path: path + "/0"})
+			}
+			for i := len(aValue) - shift; i < len(bValue); i++ {
+				ops = append(ops, &PatchOp{Op: "add", Path: path + "/-", Value: bValue[i]})
+			}
+			return ops
+		}
+		common := len(aValue)
+		if len(bValue) < common {
+			common = len(bValue)
+		}
+		for i := 0; i < common; i++ {
+			ops = append(ops, computeValuePatch(path+"/"+strconv.Itoa(i), aValue[i], bValue[i], false)...)
+		}
+		// remove from the end so that earlier indices stay valid
+		for i := len(aValue) - 1; i >= common; i-- {
+			ops = append(ops, &PatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(bValue); i++ {
+			ops = append(ops, &PatchOp{Op: "add", Path: path + "/-", Value: bValue[i]})
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, &PatchOp{Op: "replace", Path: path, Value: b})
+	}
+	return ops
+}
+
+// shiftedBy returns how many elements need to be dropped from the front of a so
+// that what's left is the start of b, or 0 if that's not possible without
+// dropping everything
+func shiftedBy(a []interface{}, b []interface{}) int {
+	for shift := 0; shift < len(a); shift++ {
+		kept := len(a) - shift
+		if kept <= len(b) && reflect.DeepEqual(a[shift:], b[:kept]) {
+			return shift
+		}
+	}
+	return 0
+}
+
+func sortedKeys(a map[string]interface{}, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,272 @@
+package muddy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Properties may optionally be declared with a type and constraints via
+// ClassDef.AddTypedProperty. Once declared, Object.Set rejects values which
+// don't match. Properties added with plain AddProperty accept anything.
+
+type PropertyType int
+
+const (
+	AnyType PropertyType = iota
+	StringType
+	IntType
+	BoolType
+	FloatType
+	ListType
+	ObjectRefType
+)
+
+func (t PropertyType) String() string {
+	switch t {
+	case StringType:
+		return "string"
+	case IntType:
+		return "int"
+	case BoolType:
+		return "bool"
+	case FloatType:
+		return "float"
+	case ListType:
+		return "list"
+	case ObjectRefType:
+		return "object reference"
+	}
+	return "any"
+}
+
+// matches returns true if value is of this type. nil is only allowed for object references.
+func (t PropertyType) matches(value interface{}) bool {
+	switch t {
+	case StringType:
+		_, ok := value.(string)
+		return ok
+	case IntType:
+		_, ok := value.(int)
+		return ok
+	case BoolType:
+		_, ok := value.(bool)
+		return ok
+	case FloatType:
+		_, ok := value.(float64)
+		return ok
+	case ListType:
+		_, ok := value.([]interface{})
+		return ok
+	case ObjectRefType:
+		_, ok := value.(ObjectRef)
+		return ok || value == nil
+	}
+	return true
+}
+
+var ErrNoSuchProperty = errors.New("no such property")
+var ErrWrongType = errors.New("wrong type")
+var ErrConstraint = errors.New("constraint violated")
+
+type PropertyError struct {
+	ObjectID int
+	Name     string
+	Err      error
+	Detail   string
+}
+
+func (e *PropertyError) Error() string {
+	msg := fmt.Sprintf("property \"%s\" of object %d: %v", e.Name, e.ObjectID, e.Err)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	return msg
+}
+
+func (e *PropertyError) Unwrap() error {
+	return e.Err
+}
+
+// Constraint checks a value which is already known to be of the declared type.
+// It returns a description of the problem, or "" if the value is acceptable.
+type Constraint func(value interface{}) string
+
+func IntRange(min int, max int) Constraint {
+	return func(value interface{}) string {
+		v := value.(int)
+		if v < min || v > max {
+			return fmt.Sprintf("%d is not between %d and %d", v, min, max)
+		}
+		return ""
+	}
+}
+
+// MaxLength limits the length of strings and lists
+func MaxLength(max int) Constraint {
+	return func(value interface{}) string {
+		length := 0
+		switch v := value.(type) {
+		case string:
+			length = len(v)
+		case []interface{}:
+			length = len(v)
+		}
+		if length > max {
+			return fmt.Sprintf("length %d is more than %d", length, max)
+		}
+		return ""
+	}
+}
+
+func OneOf(allowed ...interface{}) Constraint {
+	return func(value interface{}) string {
+		for _, a := range allowed {
+			if a == value {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%v is not one of %v", value, allowed)
+	}
+}
+
+type PropertySchema struct {
+	Type        PropertyType
+	Constraints []Constraint
+}
+
+// check validates a value which has already been through normalizeValue
+func (schema *PropertySchema) check(value interface{}) (string, error) {
+	if !schema.Type.matches(value) {
+		return fmt.Sprintf("expected %v but got %T", schema.Type, value), ErrWrongType
+	}
+	if value == nil {
+		return "", nil
+	}
+	for _, constraint := range schema.Constraints {
+		if problem := constraint(value); problem != "" {
+			return problem, ErrConstraint
+		}
+	}
+	return "", nil
+}
+
+// AddTypedProperty is like AddProperty but only allows values of the given type
+// which satisfy all the constraints to be stored in the property.
+func (c *ClassDef) AddTypedProperty(name string, propType PropertyType, initialValue interface{}, constraints ...Constraint) *ClassDef {
+	schema := &PropertySchema{Type: propType, Constraints: constraints}
+	if detail, err := schema.check(normalizeValue(initialValue)); err != nil {
+		panic(fmt.Sprintf("Initial value of property %s on class %s is invalid: %v (%s)", name, c.Name, err, detail))
+	}
+	c.propertySchemas[name] = schema
+	return c.AddProperty(name, initialValue)
+}
+
+// PropertySchema returns the declared schema for a property, or nil if the property is untyped.
+func (c *ClassDef) PropertySchema(name string) *PropertySchema {
+	return c.propertySchemas[name]
+}
+
+// TrySet stores a value in a property, returning an error if the value doesn't
+// match the property's schema.
+func (obj *Object) TrySet(name string, value interface{}) error {
+	value = normalizeValue(value)
+	state := obj.state()
+	if state == nil {
+		return &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrNoSuchObject}
+	}
+	if obj.world.readOnly {
+		return &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrReadOnly}
+	}
+	if schema, ok := state.classDef.propertySchemas[name]; ok {
+		if detail, err := schema.check(value); err != nil {
+			return &PropertyError{ObjectID: obj.ID, Name: name, Err: err, Detail: detail}
+		}
+	}
+	obj.mutableState().properties[name] = value
+	return nil
+}
+
+func (obj *Object) lookup(name string) (interface{}, error) {
+	state := obj.state()
+	if state == nil {
+		return nil, &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrNoSuchObject}
+	}
+	value, ok := state.properties[name]
+	if !ok {
+		return nil, &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrNoSuchProperty}
+	}
+	return value, nil
+}
+
+func (obj *Object) wrongType(name string, expected PropertyType, value interface{}) error {
+	return &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrWrongType, Detail: fmt.Sprintf("expected %v but got %T", expected, value)}
+}
+
+func (obj *Object) GetString(name string) (string, error) {
+	value, err := obj.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	v, ok := value.(string)
+	if !ok {
+		return "", obj.wrongType(name, StringType, value)
+	}
+	return v, nil
+}
+
+func (obj *Object) GetInt(name string) (int, error) {
+	value, err := obj.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := value.(int)
+	if !ok {
+		return 0, obj.wrongType(name, IntType, value)
+	}
+	return v, nil
+}
+
+func (obj *Object) GetBool(name string) (bool, error) {
+	value, err := obj.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	v, ok := value.(bool)
+	if !ok {
+		return false, obj.wrongType(name, BoolType, value)
+	}
+	return v, nil
+}
+
+func (obj *Object) GetList(name string) ([]interface{}, error) {
+	value, err := obj.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := value.([]interface{})
+	if !ok {
+		return nil, obj.wrongType(name, ListType, value)
+	}
+	return resolveValue(obj.world, v).([]interface{}), nil
+}
+
+// GetRef returns the object a property refers to. A nil reference is not an error,
+// but a reference to an object which no longer exists is.
+func (obj *Object) GetRef(name string) (*Object, error) {
+	value, err := obj.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	ref, ok := value.(ObjectRef)
+	if !ok {
+		return nil, obj.wrongType(name, ObjectRefType, value)
+	}
+	target := resolveValue(obj.world, ref)
+	if target == nil {
+		return nil, &PropertyError{ObjectID: obj.ID, Name: name, Err: ErrDanglingReference, Detail: fmt.Sprintf("object %d", ref.ID)}
+	}
+	return target.(*Object), nil
+}
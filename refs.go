@@ -0,0 +1,174 @@
+package muddy
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// ObjectRef is how a property refers to another object. Storing an *Object in a
+// property stores an ObjectRef instead, so that the reference is resolved
+// against whichever world the property's owner belongs to. This keeps
+// references pointing at the right objects after World.Clone and lets them be
+// saved in snapshots. Get resolves refs back into *Objects.
+type ObjectRef struct {
+	ID int
+}
+
+func Ref(obj *Object) ObjectRef {
+	return ObjectRef{ID: obj.ID}
+}
+
+var ErrDanglingReference = errors.New("refers to an object which no longer exists")
+
+// normalizeValue converts any *Objects in a value into ObjectRefs
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *Object:
+		if v == nil {
+			return nil
+		}
+		return ObjectRef{ID: v.ID}
+	case []interface{}:
+		var newList []interface{}
+		for i, element := range v {
+			normalized := normalizeValue(element)
+			// values like lists and maps can't be compared with !=, so assume
+			// they changed and copy the list
+			changed := element != nil && !reflect.TypeOf(element).Comparable()
+			if newList == nil && (changed || normalized != element) {
+				newList = append(make([]interface{}, 0, len(v)), v[:i]...)
+			}
+			if newList != nil {
+				newList = append(newList, normalized)
+			}
+		}
+		if newList != nil {
+			return newList
+		}
+	}
+	return value
+}
+
+// resolveValue converts any ObjectRefs in a value into *Objects from the given
+// world. References to objects which don't exist become nil.
+func resolveValue(w *World, value interface{}) interface{} {
+	switch v := value.(type) {
+	case ObjectRef:
+		if w == nil {
+			return nil
+		}
+		if obj := w.GetObject(v.ID); obj != nil {
+			return obj
+		}
+		return nil
+	case []interface{}:
+		if !containsRef(v) {
+			return v
+		}
+		newList := make([]interface{}, len(v))
+		for i, element := range v {
+			newList[i] = resolveValue(w, element)
+		}
+		return newList
+	}
+	return value
+}
+
+func containsRef(list []interface{}) bool {
+	for _, element := range list {
+		switch v := element.(type) {
+		case ObjectRef:
+			return true
+		case []interface{}:
+			if containsRef(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DanglingReference describes a property which refers to an object that is no
+// longer in the world.
+type DanglingReference struct {
+	ObjectID int
+	Property string
+	TargetID int
+}
+
+func (w *World) isMissing(ID int) bool {
+	return w.objects.get(ID) == nil
+}
+
+func findRefs(objID int, property string, value interface{}, matches func(int) bool, found []*DanglingReference) []*DanglingReference {
+	switch v := value.(type) {
+	case ObjectRef:
+		if matches(v.ID) {
+			found = append(found, &DanglingReference{ObjectID: objID, Property: property, TargetID: v.ID})
+		}
+	case []interface{}:
+		for _, element := range v {
+			found = findRefs(objID, property, element, matches, found)
+		}
+	}
+	return found
+}
+
+// FindDanglingReferences reports every property which refers to an object that
+// is no longer in the world, ordered by object ID and property name.
+func (w *World) FindDanglingReferences() []*DanglingReference {
+	return w.findRefsTo(w.isMissing)
+}
+
+func (w *World) findRefsTo(matches func(int) bool) []*DanglingReference {
+	found := make([]*DanglingReference, 0)
+	w.objects.each(func(ID int, state *objectState) {
+		names := make([]string, 0, len(state.properties))
+		for name := range state.properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			found = findRefs(ID, name, state.properties[name], matches, found)
+		}
+	})
+	return found
+}
+
+// clearRefs returns value with matching references set to nil (or removed, if
+// they're in a list)
+func clearRefs(value interface{}, matches func(int) bool) interface{} {
+	switch v := value.(type) {
+	case ObjectRef:
+		if matches(v.ID) {
+			return nil
+		}
+	case []interface{}:
+		newList := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if ref, ok := element.(ObjectRef); ok && matches(ref.ID) {
+				continue
+			}
+			newList = append(newList, clearRefs(element, matches))
+		}
+		return newList
+	}
+	return value
+}
+
+// ClearDanglingReferences removes every reference to an object which is no
+// longer in the world. Properties holding such a reference are set to nil and
+// lists have the reference removed. Returns what was cleared.
+func (w *World) ClearDanglingReferences() []*DanglingReference {
+	return w.clearRefsTo(w.isMissing)
+}
+
+func (w *World) clearRefsTo(matches func(int) bool) []*DanglingReference {
+	found := w.findRefsTo(matches)
+	for _, d := range found {
+		state := w.handle(d.ObjectID).mutableState()
+		state.properties[d.Property] = clearRefs(state.properties[d.Property], matches)
+	}
+	return found
+}
@@ -2,11 +2,34 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/pgm/muddy"
 )
 
 func main() {
 	log.Printf("Starting...")
-	muddy.Start("127.0.0.1:7200")
+
+	worldBuilder := func() *muddy.WorldBasics {
+		return muddy.NewWorldBasics(muddy.NewWorld())
+	}
+	if len(os.Args) > 1 {
+		var err error
+		worldBuilder, err = muddy.LoadWorldFile(os.Args[1])
+		if err != nil {
+			log.Fatalf("Could not load world: %v", err)
+		}
+	}
+
+	// players who send {"builder": "<token>"} can change the world as they play
+	if token := os.Getenv("MUDDY_BUILDER_TOKEN"); token != "" {
+		buildWorld := worldBuilder
+		worldBuilder = func() *muddy.WorldBasics {
+			world := buildWorld()
+			world.BuilderToken = token
+			return world
+		}
+	}
+
+	muddy.Start("127.0.0.1:7200", worldBuilder)
 }
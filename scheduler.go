@@ -0,0 +1,305 @@
+package muddy
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a world. Worlds use RealClock unless told
+// otherwise, but tests swap in a ManualClock so that timers fire exactly when
+// they're told to.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer which fires once d has passed
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer fires once, sending the time on C. Stop it if it's no longer needed.
+type ClockTimer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. Returns false if it already had.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+var RealClock Clock = realClock{}
+
+// ManualClock only moves when Advance is called
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*manualWaiter
+}
+
+type manualWaiter struct {
+	clock    *ManualClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) ClockTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	waiter := &manualWaiter{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		waiter.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, waiter)
+	}
+	return waiter
+}
+
+func (w *manualWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *manualWaiter) Stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	for i, waiter := range w.clock.waiters {
+		if waiter == w {
+			w.clock.waiters = append(w.clock.waiters[:i:i], w.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward, firing any timers which are now due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	waiting := make([]*manualWaiter, 0, len(c.waiters))
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+type timer struct {
+	ID       int
+	deadline time.Time
+	// zero unless the timer repeats
+	interval time.Duration
+	callback func(ctx *Context)
+	// only set for countdowns, which are shown to players
+	countdown *countdown
+}
+
+// countdown is the part of a timer which players can see. Worlds keep these so
+// that views (which are rendered from snapshots) can show the time remaining.
+type countdown struct {
+	deadline time.Time
+	// shown to everyone if global is set, otherwise only to players in or
+	// carried by the object with ID scopeID
+	global  bool
+	scopeID int
+}
+
+// Scheduler runs callbacks at some point in the future. Each world has one (as
+// World.Scheduler), which its event loop runs when the next timer is due, so
+// callbacks are free to change the world and a snapshot goes out after they
+// run. Timers aren't part of the world's state, so they aren't included in
+// snapshots or clones.
+type Scheduler struct {
+	world  *World
+	nextID int
+	timers map[int]*timer
+}
+
+func NewScheduler(world *World) *Scheduler {
+	return &Scheduler{world: world, nextID: 1, timers: make(map[int]*timer)}
+}
+
+func (s *Scheduler) add(t *timer) int {
+	t.ID = s.nextID
+	s.nextID++
+	s.timers[t.ID] = t
+	s.updateCountdowns()
+	return t.ID
+}
+
+// After calls callback once d has passed. Returns an ID which can be passed to Cancel.
+func (s *Scheduler) After(d time.Duration, callback func(ctx *Context)) int {
+	return s.add(&timer{deadline: s.world.Clock.Now().Add(d), callback: callback})
+}
+
+// Every calls callback each time d passes, until it's cancelled
+func (s *Scheduler) Every(d time.Duration, callback func(ctx *Context)) int {
+	if d <= 0 {
+		panic("interval of a repeating timer must be positive")
+	}
+	return s.add(&timer{deadline: s.world.Clock.Now().Add(d), interval: d, callback: callback})
+}
+
+// Countdown is like After, but the time remaining is shown to players. If scope
+// is nil everyone sees it, otherwise only the players in (or carrying) scope do.
+func (s *Scheduler) Countdown(d time.Duration, scope *Object, callback func(ctx *Context)) int {
+	deadline := s.world.Clock.Now().Add(d)
+	c := &countdown{deadline: deadline, global: scope == nil}
+	if scope != nil {
+		c.scopeID = scope.ID
+	}
+	return s.add(&timer{deadline: deadline, callback: callback, countdown: c})
+}
+
+// Cancel stops a timer from firing. Returns false if it had already fired or been cancelled.
+func (s *Scheduler) Cancel(ID int) bool {
+	if _, ok := s.timers[ID]; !ok {
+		return false
+	}
+	delete(s.timers, ID)
+	s.updateCountdowns()
+	return true
+}
+
+// Remaining returns how long until the timer fires next
+func (s *Scheduler) Remaining(ID int) (time.Duration, bool) {
+	t, ok := s.timers[ID]
+	if !ok {
+		return 0, false
+	}
+	return t.deadline.Sub(s.world.Clock.Now()), true
+}
+
+// Pending returns how many timers are waiting to run
+func (s *Scheduler) Pending() int {
+	return len(s.timers)
+}
+
+// Next returns when the earliest timer is due, or false if there aren't any
+func (s *Scheduler) Next() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, t := range s.timers {
+		if !found || t.deadline.Before(next) {
+			next = t.deadline
+			found = true
+		}
+	}
+	return next, found
+}
+
+// RunDue calls the callbacks of every timer which is due, in the order they
+// were due, and returns how many ran. Repeating timers are rescheduled.
+// Callbacks get a Context with no Player, since no one in particular caused them.
+func (s *Scheduler) RunDue() int {
+	now := s.world.Clock.Now()
+	due := make([]*timer, 0)
+	for _, t := range s.timers {
+		if !t.deadline.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].deadline.Equal(due[j].deadline) {
+			return due[i].ID < due[j].ID
+		}
+		return due[i].deadline.Before(due[j].deadline)
+	})
+
+	ctx := &Context{World: s.world}
+	ran := 0
+	for _, t := range due {
+		// an earlier callback may have cancelled this one
+		if _, ok := s.timers[t.ID]; !ok {
+			continue
+		}
+		if t.interval > 0 {
+			t.deadline = t.deadline.Add(t.interval)
+		} else {
+			delete(s.timers, t.ID)
+		}
+		s.runCallback(ctx, t)
+		ran++
+	}
+	s.updateCountdowns()
+	return ran
+}
+
+// runCallback calls a timer's callback, so that one which panics is logged
+// and doesn't stop the others from running.
+func (s *Scheduler) runCallback(ctx *Context, t *timer) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Timer %d panicked: %v\n%s", t.ID, r, debug.Stack())
+		}
+	}()
+	t.callback(ctx)
+}
+
+func (s *Scheduler) updateCountdowns() {
+	countdowns := make([]*countdown, 0)
+	for _, t := range s.timers {
+		if t.countdown != nil {
+			countdowns = append(countdowns, t.countdown)
+		}
+	}
+	// replaced rather than modified, since snapshots share the old list
+	s.world.countdowns = countdowns
+}
+
+// timeRemaining returns the number of seconds left on the soonest countdown the
+// player can see, or 0 if there aren't any
+func (w *World) timeRemaining(player *Object) float64 {
+	var remaining time.Duration
+	found := false
+	for _, c := range w.countdowns {
+		visible := c.global
+		for obj := player; obj != nil && !visible; obj = obj.Parent() {
+			visible = obj.ID == c.scopeID
+		}
+		if !visible {
+			continue
+		}
+		left := c.deadline.Sub(w.Clock.Now())
+		if !found || left < remaining {
+			remaining = left
+			found = true
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	// whole seconds, so that views don't change every time they're rendered
+	return remaining.Round(time.Second).Seconds()
+}
@@ -0,0 +1,120 @@
+package muddy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgm/muddy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	world := muddy.NewWorld()
+	clock := muddy.NewManualClock(time.Unix(0, 0))
+	world.Clock = clock
+	basic := muddy.NewWorldBasics(world)
+	scheduler := basic.World.Scheduler
+
+	fired := make([]string, 0)
+	scheduler.After(10*time.Second, func(ctx *muddy.Context) { fired = append(fired, "once") })
+	every := scheduler.Every(4*time.Second, func(ctx *muddy.Context) { fired = append(fired, "every") })
+	cancelled := scheduler.After(time.Second, func(ctx *muddy.Context) { fired = append(fired, "cancelled") })
+	assert.True(t, scheduler.Cancel(cancelled))
+	assert.False(t, scheduler.Cancel(cancelled))
+
+	next, ok := scheduler.Next()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(4, 0), next)
+
+	// a callback which panics doesn't stop the others
+	scheduler.After(4*time.Second, func(ctx *muddy.Context) { panic("boom") })
+
+	assert.Equal(t, 0, scheduler.RunDue())
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, 2, scheduler.RunDue())
+	clock.Advance(6 * time.Second)
+	assert.Equal(t, 2, scheduler.RunDue())
+	assert.Equal(t, []string{"every", "every", "once"}, fired)
+
+	remaining, ok := scheduler.Remaining(every)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, remaining)
+	scheduler.Cancel(every)
+	_, ok = scheduler.Next()
+	assert.False(t, ok)
+}
+
+func TestCountdown(t *testing.T) {
+	world := muddy.NewWorld()
+	clock := muddy.NewManualClock(time.Unix(0, 0))
+	world.Clock = clock
+	basic := muddy.NewWorldBasics(world)
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ann := basic.AddPlayer("ann", tiny.Beach)
+
+	door := basic.AddItem(tiny.Castle, "door").Set("open", true)
+	basic.World.Scheduler.Countdown(30*time.Second, tiny.Castle, func(ctx *muddy.Context) {
+		door.Set("open", false)
+	})
+	basic.World.Scheduler.Countdown(time.Hour, nil, func(ctx *muddy.Context) {})
+
+	assert.Equal(t, 30.0, world.GetView(joe.ID).TimeRemaining)
+	assert.Equal(t, 3600.0, world.GetView(ann.ID).TimeRemaining)
+
+	// snapshots keep the countdowns they were taken with
+	snapshot := world.Clone()
+	clock.Advance(30 * time.Second)
+	basic.World.Scheduler.RunDue()
+	assert.Equal(t, false, door.Get("open"))
+	assert.Equal(t, 3570.0, world.GetView(joe.ID).TimeRemaining)
+	assert.Equal(t, 0.0, snapshot.GetView(joe.ID).TimeRemaining)
+	assert.Equal(t, true, snapshot.GetObject(door.ID).Get("open"))
+}
+
+func TestSchedulerFromMethods(t *testing.T) {
+	world := muddy.NewWorld()
+	clock := muddy.NewManualClock(time.Unix(0, 0))
+	world.Clock = clock
+	basic := muddy.NewWorldBasics(world)
+	tiny := NewTinyland(basic)
+	ctx := &muddy.Context{World: world}
+
+	// methods reach the scheduler through the world they're called in
+	Door := basic.Thing.Subclass("Door").AddMethod("Open", func(obj *muddy.Object, ctx *muddy.Context) {
+		obj.Set("open", true)
+		ctx.World.Scheduler.After(30*time.Second, func(ctx *muddy.Context) {
+			obj.Call(ctx, "close")
+		})
+	}).AddScriptMethod("close", nil, `self.open = false`).
+		AddScriptMethod("Knock", nil, `return after(5, self, "Open")`)
+	door := world.AddObject(tiny.Castle, Door)
+
+	door.Call(ctx, "Knock")
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 1, world.Scheduler.RunDue())
+	assert.Equal(t, true, door.Get("open"))
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, 1, world.Scheduler.RunDue())
+	assert.Equal(t, false, door.Get("open"))
+
+	// timers stay with the world running them
+	assert.Nil(t, world.Clone().Scheduler)
+}
+
+func TestManualClockTimers(t *testing.T) {
+	clock := muddy.NewManualClock(time.Unix(0, 0))
+	stopped := clock.NewTimer(time.Second)
+	fired := clock.NewTimer(time.Second)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, time.Unix(1, 0), <-fired.C())
+	assert.False(t, fired.Stop())
+	select {
+	case <-stopped.C():
+		t.Error("a stopped timer fired")
+	default:
+	}
+}
@@ -0,0 +1,1712 @@
+package muddy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scripts are method bodies written in a small language instead of Go, so that
+// what objects do can be changed without rebuilding. For example:
+//
+//	if self.locked {
+//	    fail("it's locked")
+//	}
+//	tell(player, "You squeeze through the " + self.name)
+//	self.uses = self.uses + 1
+//	move(player, self.destination)
+//
+// Values are nil, true and false, integers, floats, strings, lists and objects.
+// obj.name reads a property and obj.name = value sets one (checked against the
+// property's schema, as in Go). obj.name(args) calls a method with the same
+// dispatch rules as Object.TryCall. Inside a script, self, player (nil if no
+// player caused the call) and the method's parameters are defined. Statements
+// are let name = value, name = value, if/else, while, for name in list, return
+// and expressions. Comments start with #.
+//
+// The builtin functions are:
+//
+//	tell(player, text)    adds a line to the player's messages
+//	move(obj, dest)       moves obj into dest
+//	fail(message)         stops the script, returning message as its error
+//	len(x), str(x), int(x), append(list, value)
+//	object(ID), parent(obj), children(obj), is(obj, className), has(obj, method)
+//	after(seconds, obj, method)  calls obj.method() later, returning an ID for cancel(ID)
+//
+// Scripts can only reach the world through these, and each call is limited in
+// how many steps it takes and how deeply scripts call each other, so a broken
+// script fails instead of hanging the world's event loop. Comparing, printing
+// or storing a list takes a step for every value in it.
+
+// the limits on a single call into scripts, including any scripts it calls
+const MaxScriptSteps = 10000
+const MaxScriptDepth = 32
+const MaxScriptStringLength = 65536
+const MaxScriptListLength = 10000
+
+// the limits on timers started by scripts: how far ahead they can be, and how
+// many timers a world can have waiting before scripts can't start any more
+const MaxScriptTimerDelay = 24 * time.Hour
+const MaxScriptTimers = 100
+
+var ErrScriptSyntax = errors.New("syntax error")
+var ErrScriptRuntime = errors.New("script error")
+var ErrScriptLimit = errors.New("script exceeded its limits")
+
+// ScriptError is a problem with a script, either while parsing it or running
+// it. Use errors.Is to check which of the ErrScript* values above caused it.
+type ScriptError struct {
+	Line    int
+	Column  int
+	Message string
+	Err     error
+}
+
+func (e *ScriptError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%v at line %d, column %d: %s", e.Err, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%v at line %d: %s", e.Err, e.Line, e.Message)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// Script is a parsed method body. Scripts are immutable, so one can be shared
+// by every object and world which uses it.
+type Script struct {
+	source string
+	body   []scriptStmt
+}
+
+func ParseScript(source string) (*Script, error) {
+	tokens, err := lexScript(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	body, err := p.statements(func(t *scriptToken) bool { return t.kind == tokenEOF })
+	if err != nil {
+		return nil, err
+	}
+	return &Script{source: source, body: body}, nil
+}
+
+// how many parsed scripts are kept, so that the scripts attached to objects
+// (which are stored as source) aren't parsed every time they're called
+const MaxCachedScripts = 1000
+
+// scriptCache keeps the most recently used scripts. Views are rendered by many
+// goroutines at once, hence the mutex.
+type scriptCache struct {
+	mutex   sync.Mutex
+	scripts map[string]*list.Element
+	// of *Script, most recently used first
+	order *list.List
+}
+
+var parsedScripts = &scriptCache{scripts: make(map[string]*list.Element), order: list.New()}
+
+func (c *scriptCache) get(source string) *Script {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.scripts[source]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*Script)
+}
+
+func (c *scriptCache) add(script *Script) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.scripts[script.source]; ok {
+		return
+	}
+	c.scripts[script.source] = c.order.PushFront(script)
+	for c.order.Len() > MaxCachedScripts {
+		oldest := c.order.Remove(c.order.Back()).(*Script)
+		delete(c.scripts, oldest.source)
+	}
+}
+
+func parseCachedScript(source string) (*Script, error) {
+	if script := parsedScripts.get(source); script != nil {
+		return script, nil
+	}
+	script, err := ParseScript(source)
+	if err != nil {
+		return nil, err
+	}
+	parsedScripts.add(script)
+	return script, nil
+}
+
+// method adapts the script so it can be called like any other method
+func (s *Script) method(params []string) MethodType {
+	params = append([]string(nil), params...)
+	return func(obj *Object, ctx *Context, args []interface{}) (interface{}, error) {
+		if len(args) != len(params) {
+			return nil, &MethodError{Err: ErrBadArity, Detail: fmt.Sprintf("expects %d args, but called with %d args", len(params), len(args))}
+		}
+		return s.run(obj, ctx, params, args)
+	}
+}
+
+// TryAddScriptMethod adds a method to the class whose body is a script. The
+// arguments it's called with are bound to the names in params.
+func (c *ClassDef) TryAddScriptMethod(name string, params []string, source string) error {
+	script, err := ParseScript(source)
+	if err != nil {
+		return err
+	}
+	c.methodDispatch[name] = script.method(params)
+	return nil
+}
+
+// AddScriptMethod is like TryAddScriptMethod, but panics if the script doesn't parse. Returns c so calls can be chained.
+func (c *ClassDef) AddScriptMethod(name string, params []string, source string) *ClassDef {
+	if err := c.TryAddScriptMethod(name, params, source); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// scripts attached to a single object are kept in a property, so that they're
+// part of the world's state like everything else about the object
+const scriptPropertyPrefix = "script:"
+
+// TrySetScript gives this object its own method, which takes precedence over
+// its class's method of the same name. Passing an empty source removes it.
+func (obj *Object) TrySetScript(name string, params []string, source string) error {
+	if source == "" {
+		return obj.TrySet(scriptPropertyPrefix+name, nil)
+	}
+	if _, err := parseCachedScript(source); err != nil {
+		return err
+	}
+	return obj.TrySet(scriptPropertyPrefix+name, []interface{}{stringList(params), source})
+}
+
+// SetScript is like TrySetScript, but panics if the script doesn't parse. Returns obj so calls can be chained.
+func (obj *Object) SetScript(name string, params []string, source string) *Object {
+	if err := obj.TrySetScript(name, params, source); err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+// objectScript returns the method an object has been given with SetScript, if any
+func objectScript(state *objectState, name string) (MethodType, error) {
+	value, ok := state.properties[scriptPropertyPrefix+name].([]interface{})
+	if !ok || len(value) != 2 {
+		return nil, nil
+	}
+	params, _ := value[0].([]interface{})
+	source, _ := value[1].(string)
+	script, err := parseCachedScript(source)
+	if err != nil {
+		return nil, err
+	}
+	return script.method(listStrings(params)), nil
+}
+
+// scriptBudget is shared by every script run on behalf of a single call from Go
+type scriptBudget struct {
+	steps int
+	depth int
+}
+
+type scriptRun struct {
+	ctx *Context
+	// the world self is in, which scripts can't reach outside of
+	world  *World
+	vars   map[string]interface{}
+	budget *scriptBudget
+}
+
+// scriptReturn unwinds the statements of a script when it returns
+type scriptReturn struct {
+	value interface{}
+}
+
+func (r *scriptReturn) Error() string {
+	return "return outside of a script"
+}
+
+func (s *Script) run(obj *Object, ctx *Context, params []string, args []interface{}) (interface{}, error) {
+	if ctx == nil {
+		ctx = &Context{World: obj.world}
+	}
+	if ctx.scriptBudget == nil {
+		ctx.scriptBudget = &scriptBudget{}
+		defer func() { ctx.scriptBudget = nil }()
+	}
+	budget := ctx.scriptBudget
+	budget.depth++
+	defer func() { budget.depth-- }()
+	if budget.depth > MaxScriptDepth {
+		return nil, &ScriptError{Line: 1, Message: fmt.Sprintf("scripts called each other more than %d deep", MaxScriptDepth), Err: ErrScriptLimit}
+	}
+
+	r := &scriptRun{ctx: ctx, world: obj.world, vars: make(map[string]interface{}), budget: budget}
+	r.vars["self"] = obj
+	r.vars["player"] = nil
+	if ctx.Player != nil {
+		r.vars["player"] = ctx.Player
+	}
+	for i, param := range params {
+		r.vars[param] = scriptValue(args[i])
+	}
+
+	err := r.execAll(s.body)
+	if ret, ok := err.(*scriptReturn); ok {
+		return ret.value, nil
+	}
+	return nil, err
+}
+
+func (r *scriptRun) step(line int) error {
+	r.budget.steps++
+	if r.budget.steps > MaxScriptSteps {
+		return r.limitf(line, "took more than %d steps", MaxScriptSteps)
+	}
+	return nil
+}
+
+func (r *scriptRun) errorf(line int, format string, args ...interface{}) error {
+	return &ScriptError{Line: line, Message: fmt.Sprintf(format, args...), Err: ErrScriptRuntime}
+}
+
+func (r *scriptRun) execAll(stmts []scriptStmt) error {
+	for _, stmt := range stmts {
+		if err := r.step(stmt.line()); err != nil {
+			return err
+		}
+		if err := stmt.exec(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptValue converts what Go methods and properties return into the values
+// scripts work with, ie: any kind of slice becomes a []interface{}
+func scriptValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, float64, []interface{}:
+		return v
+	case *Object:
+		if v == nil {
+			return nil
+		}
+		return v
+	case float32:
+		return float64(v)
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = scriptValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	case reflect.String:
+		return rv.String()
+	case reflect.Ptr, reflect.Interface, reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return value
+}
+
+func scriptTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case []interface{}:
+		return "list"
+	case *Object:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func scriptTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// equal compares two values, using up a step for each one it looks at. Lists
+// can share elements, so a list built in a few steps can hold far more values
+// than that, and every walk over one has to count against the budget.
+func (r *scriptRun) equal(line int, a interface{}, b interface{}) (bool, error) {
+	if err := r.step(line); err != nil {
+		return false, err
+	}
+	if af, aIsNum := scriptNumber(a); aIsNum {
+		bf, bIsNum := scriptNumber(b)
+		return bIsNum && af == bf, nil
+	}
+	if aList, ok := a.([]interface{}); ok {
+		bList, ok := b.([]interface{})
+		if !ok || len(aList) != len(bList) {
+			return false, nil
+		}
+		for i := range aList {
+			if equal, err := r.equal(line, aList[i], bList[i]); !equal || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	// values from Go, such as maps, may not be comparable
+	if a != nil && !reflect.TypeOf(a).Comparable() || b != nil && !reflect.TypeOf(b).Comparable() {
+		return false, nil
+	}
+	return a == b, nil
+}
+
+// charge uses up a step for each value within value, for when Go code (such as
+// Set) is about to walk it
+func (r *scriptRun) charge(line int, value interface{}) error {
+	if err := r.step(line); err != nil {
+		return err
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, element := range list {
+			if err := r.charge(line, element); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copied uses up steps for copying n values (or bytes of a string), which is
+// cheap but not free
+func (r *scriptRun) copied(line int, n int) error {
+	for i := 0; i < n; i += 1024 {
+		if err := r.step(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *scriptRun) limitf(line int, format string, args ...interface{}) error {
+	return &ScriptError{Line: line, Message: fmt.Sprintf(format, args...), Err: ErrScriptLimit}
+}
+
+func scriptNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// str converts a value to text, using up a step for each value it looks at.
+// The result is limited to MaxScriptStringLength.
+func (r *scriptRun) str(line int, value interface{}) (string, error) {
+	var b strings.Builder
+	if err := r.writeString(line, &b, value); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (r *scriptRun) writeString(line int, b *strings.Builder, value interface{}) error {
+	if err := r.step(line); err != nil {
+		return err
+	}
+	var text string
+	switch v := value.(type) {
+	case []interface{}:
+		b.WriteString("[")
+		for i, element := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if err := r.writeString(line, b, element); err != nil {
+				return err
+			}
+		}
+		text = "]"
+	case nil:
+		text = "nil"
+	case string:
+		text = v
+	case *Object:
+		if name, ok := v.Get("name").(string); ok {
+			text = name
+		} else {
+			text = "#" + strconv.Itoa(v.ID)
+		}
+	default:
+		text = fmt.Sprint(value)
+	}
+	if b.Len()+len(text) > MaxScriptStringLength {
+		return r.limitf(line, "strings can't be longer than %d", MaxScriptStringLength)
+	}
+	b.WriteString(text)
+	return nil
+}
+
+// statements
+
+type scriptStmt interface {
+	exec(r *scriptRun) error
+	line() int
+}
+
+type scriptPos struct {
+	at int
+}
+
+func (p scriptPos) line() int {
+	return p.at
+}
+
+type letStmt struct {
+	scriptPos
+	name  string
+	value scriptExpr
+}
+
+func (s *letStmt) exec(r *scriptRun) error {
+	value, err := s.value.eval(r)
+	if err != nil {
+		return err
+	}
+	r.vars[s.name] = value
+	return nil
+}
+
+type assignStmt struct {
+	scriptPos
+	target scriptExpr
+	value  scriptExpr
+}
+
+func (s *assignStmt) exec(r *scriptRun) error {
+	value, err := s.value.eval(r)
+	if err != nil {
+		return err
+	}
+	switch target := s.target.(type) {
+	case *variableExpr:
+		if _, ok := r.vars[target.name]; !ok {
+			return r.errorf(s.at, "%s hasn't been declared (use let)", target.name)
+		}
+		r.vars[target.name] = value
+		return nil
+	case *memberExpr:
+		obj, err := target.object(r)
+		if err != nil {
+			return err
+		}
+		if err := r.charge(s.at, value); err != nil {
+			return err
+		}
+		// a PropertyError, the same as setting it from Go
+		return obj.TrySet(target.name, value)
+	case *indexExpr:
+		// lists are values, so update a copy and assign it back
+		list, index, err := target.operands(r)
+		if err != nil {
+			return err
+		}
+		newList := append([]interface{}(nil), list...)
+		newList[index] = value
+		return (&assignStmt{scriptPos: s.scriptPos, target: target.list, value: &literalExpr{value: newList}}).exec(r)
+	}
+	return r.errorf(s.at, "can't assign to that")
+}
+
+type ifStmt struct {
+	scriptPos
+	cond      scriptExpr
+	then      []scriptStmt
+	otherwise []scriptStmt
+}
+
+func (s *ifStmt) exec(r *scriptRun) error {
+	cond, err := s.cond.eval(r)
+	if err != nil {
+		return err
+	}
+	if scriptTruthy(cond) {
+		return r.execAll(s.then)
+	}
+	return r.execAll(s.otherwise)
+}
+
+type whileStmt struct {
+	scriptPos
+	cond scriptExpr
+	body []scriptStmt
+}
+
+func (s *whileStmt) exec(r *scriptRun) error {
+	for {
+		if err := r.step(s.at); err != nil {
+			return err
+		}
+		cond, err := s.cond.eval(r)
+		if err != nil {
+			return err
+		}
+		if !scriptTruthy(cond) {
+			return nil
+		}
+		if err := r.execAll(s.body); err != nil {
+			return err
+		}
+	}
+}
+
+type forStmt struct {
+	scriptPos
+	name string
+	list scriptExpr
+	body []scriptStmt
+}
+
+func (s *forStmt) exec(r *scriptRun) error {
+	value, err := s.list.eval(r)
+	if err != nil {
+		return err
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return r.errorf(s.at, "can't loop over %s", scriptTypeName(value))
+	}
+	for _, element := range list {
+		if err := r.step(s.at); err != nil {
+			return err
+		}
+		r.vars[s.name] = element
+		if err := r.execAll(s.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type returnStmt struct {
+	scriptPos
+	value scriptExpr
+}
+
+func (s *returnStmt) exec(r *scriptRun) error {
+	var value interface{}
+	if s.value != nil {
+		var err error
+		if value, err = s.value.eval(r); err != nil {
+			return err
+		}
+		// whoever called the script may walk what it returns
+		if err := r.charge(s.at, value); err != nil {
+			return err
+		}
+	}
+	return &scriptReturn{value: value}
+}
+
+type exprStmt struct {
+	scriptPos
+	expr scriptExpr
+}
+
+func (s *exprStmt) exec(r *scriptRun) error {
+	_, err := s.expr.eval(r)
+	return err
+}
+
+// expressions
+
+type scriptExpr interface {
+	eval(r *scriptRun) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) eval(r *scriptRun) (interface{}, error) {
+	return e.value, nil
+}
+
+type variableExpr struct {
+	scriptPos
+	name string
+}
+
+func (e *variableExpr) eval(r *scriptRun) (interface{}, error) {
+	value, ok := r.vars[e.name]
+	if !ok {
+		return nil, r.errorf(e.at, "%s hasn't been declared", e.name)
+	}
+	return value, nil
+}
+
+type listExpr struct {
+	elements []scriptExpr
+}
+
+func (e *listExpr) eval(r *scriptRun) (interface{}, error) {
+	list := make([]interface{}, len(e.elements))
+	for i, element := range e.elements {
+		value, err := element.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+type memberExpr struct {
+	scriptPos
+	obj  scriptExpr
+	name string
+}
+
+func (e *memberExpr) object(r *scriptRun) (*Object, error) {
+	value, err := e.obj.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := value.(*Object)
+	if !ok {
+		return nil, r.errorf(e.at, "%s has no property %s", scriptTypeName(value), e.name)
+	}
+	return obj, nil
+}
+
+func (e *memberExpr) eval(r *scriptRun) (interface{}, error) {
+	obj, err := e.object(r)
+	if err != nil {
+		return nil, err
+	}
+	return scriptValue(obj.Get(e.name)), nil
+}
+
+type indexExpr struct {
+	scriptPos
+	list  scriptExpr
+	index scriptExpr
+}
+
+func (e *indexExpr) operands(r *scriptRun) ([]interface{}, int, error) {
+	value, err := e.list.eval(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, 0, r.errorf(e.at, "can't index %s", scriptTypeName(value))
+	}
+	indexValue, err := e.index.eval(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, ok := indexValue.(int)
+	if !ok {
+		return nil, 0, r.errorf(e.at, "list index must be an int, not %s", scriptTypeName(indexValue))
+	}
+	if index < 0 || index >= len(list) {
+		return nil, 0, r.errorf(e.at, "index %d is out of range", index)
+	}
+	return list, index, nil
+}
+
+func (e *indexExpr) eval(r *scriptRun) (interface{}, error) {
+	list, index, err := e.operands(r)
+	if err != nil {
+		return nil, err
+	}
+	return list[index], nil
+}
+
+func (r *scriptRun) evalArgs(exprs []scriptExpr) ([]interface{}, error) {
+	args := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		value, err := expr.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return args, nil
+}
+
+type methodCallExpr struct {
+	scriptPos
+	obj    scriptExpr
+	method string
+	args   []scriptExpr
+}
+
+func (e *methodCallExpr) eval(r *scriptRun) (interface{}, error) {
+	value, err := e.obj.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := value.(*Object)
+	if !ok {
+		return nil, r.errorf(e.at, "can't call %s on %s", e.method, scriptTypeName(value))
+	}
+	args, err := r.evalArgs(e.args)
+	if err != nil {
+		return nil, err
+	}
+	// the method may walk its arguments, such as by storing them in a property
+	if err := r.charge(e.at, args); err != nil {
+		return nil, err
+	}
+	result, err := obj.TryCall(r.ctx, e.method, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scriptValue(result), nil
+}
+
+type builtinCallExpr struct {
+	scriptPos
+	name string
+	args []scriptExpr
+}
+
+type scriptBuiltin func(r *scriptRun, line int, args []interface{}) (interface{}, error)
+
+var scriptBuiltins map[string]scriptBuiltin
+
+func init() {
+	scriptBuiltins = map[string]scriptBuiltin{
+		"tell": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			target, err := r.objectArg(line, "tell", args, 0, 2)
+			if err != nil {
+				return nil, err
+			}
+			text, err := r.str(line, args[1])
+			if err != nil {
+				return nil, err
+			}
+			if err := r.checkWritable(line, "tell"); err != nil {
+				return nil, err
+			}
+			_, err = target.TryCall(r.ctx, "receiveMessage", text)
+			return nil, err
+		},
+		"move": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "move", args, 0, 2)
+			if err != nil {
+				return nil, err
+			}
+			dest, err := r.objectArg(line, "move", args, 1, 2)
+			if err != nil {
+				return nil, err
+			}
+			if err := r.checkWritable(line, "move"); err != nil {
+				return nil, err
+			}
+			for ancestor := dest; ancestor != nil; ancestor = ancestor.Parent() {
+				if ancestor == obj {
+					return nil, r.errorf(line, "can't move something inside itself")
+				}
+			}
+			obj.world.Move(obj, dest)
+			return nil, nil
+		},
+		"after": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "after", args, 1, 3)
+			if err != nil {
+				return nil, err
+			}
+			// written so that NaN fails too
+			seconds, ok := scriptNumber(args[0])
+			if !ok || !(seconds >= 0 && seconds <= MaxScriptTimerDelay.Seconds()) {
+				return nil, r.errorf(line, "after needs a number of seconds between 0 and %v", MaxScriptTimerDelay.Seconds())
+			}
+			method, ok := args[2].(string)
+			if !ok {
+				return nil, r.errorf(line, "after needs the name of a method")
+			}
+			scheduler := r.world.Scheduler
+			if scheduler == nil {
+				return nil, r.errorf(line, "this world has no scheduler")
+			}
+			if scheduler.Pending() >= MaxScriptTimers {
+				return nil, r.limitf(line, "there are already %d timers waiting", MaxScriptTimers)
+			}
+			return scheduler.After(time.Duration(seconds*float64(time.Second)), func(ctx *Context) {
+				if _, err := obj.TryCall(ctx, method); err != nil {
+					log.Printf("Timer calling %s on object %d failed: %v", method, obj.ID, err)
+				}
+			}), nil
+		},
+		"cancel": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "cancel takes 1 argument")
+			}
+			ID, ok := args[0].(int)
+			if !ok || r.world.Scheduler == nil {
+				return false, nil
+			}
+			return r.world.Scheduler.Cancel(ID), nil
+		},
+		"fail": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "fail takes 1 argument")
+			}
+			message, err := r.str(line, args[0])
+			if err != nil {
+				return nil, err
+			}
+			// reported to the player the same way as an error from a Go method
+			return nil, errors.New(message)
+		},
+		"len": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "len takes 1 argument")
+			}
+			switch v := args[0].(type) {
+			case string:
+				return utf8.RuneCountInString(v), nil
+			case []interface{}:
+				return len(v), nil
+			}
+			return nil, r.errorf(line, "%s has no length", scriptTypeName(args[0]))
+		},
+		"str": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "str takes 1 argument")
+			}
+			return r.str(line, args[0])
+		},
+		"int": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "int takes 1 argument")
+			}
+			switch v := args[0].(type) {
+			case int:
+				return v, nil
+			case float64:
+				return int(v), nil
+			case string:
+				i, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil {
+					return nil, r.errorf(line, "%q is not an int", v)
+				}
+				return i, nil
+			}
+			return nil, r.errorf(line, "%s can't be converted to an int", scriptTypeName(args[0]))
+		},
+		"append": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, r.errorf(line, "append takes 2 arguments")
+			}
+			list, ok := args[0].([]interface{})
+			if !ok {
+				return nil, r.errorf(line, "can't append to %s", scriptTypeName(args[0]))
+			}
+			if len(list) >= MaxScriptListLength {
+				return nil, r.limitf(line, "lists can't be longer than %d", MaxScriptListLength)
+			}
+			if err := r.copied(line, len(list)); err != nil {
+				return nil, err
+			}
+			return append(append([]interface{}(nil), list...), args[1]), nil
+		},
+		"object": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, r.errorf(line, "object takes 1 argument")
+			}
+			var ID int
+			switch v := args[0].(type) {
+			case int:
+				ID = v
+			case string:
+				var err error
+				if ID, err = strconv.Atoi(v); err != nil {
+					return nil, r.errorf(line, "%q is not an object ID", v)
+				}
+			default:
+				return nil, r.errorf(line, "%s is not an object ID", scriptTypeName(args[0]))
+			}
+			if obj := r.world.GetObject(ID); obj != nil {
+				return obj, nil
+			}
+			return nil, nil
+		},
+		"parent": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "parent", args, 0, 1)
+			if err != nil {
+				return nil, err
+			}
+			return scriptValue(obj.Parent()), nil
+		},
+		"children": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "children", args, 0, 1)
+			if err != nil {
+				return nil, err
+			}
+			return scriptValue(obj.Children()), nil
+		},
+		"is": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "is", args, 0, 2)
+			if err != nil {
+				return nil, err
+			}
+			className, ok := args[1].(string)
+			if !ok {
+				return nil, r.errorf(line, "is needs the name of a class")
+			}
+			return obj.IsInstanceOf(className), nil
+		},
+		"has": func(r *scriptRun, line int, args []interface{}) (interface{}, error) {
+			obj, err := r.objectArg(line, "has", args, 0, 2)
+			if err != nil {
+				return nil, err
+			}
+			method, ok := args[1].(string)
+			if !ok {
+				return nil, r.errorf(line, "has needs the name of a method")
+			}
+			return obj.HasMethod(method), nil
+		},
+	}
+}
+
+// checkWritable stops builtins from changing a snapshot, which other goroutines
+// may be reading
+func (r *scriptRun) checkWritable(line int, name string) error {
+	if r.world.readOnly {
+		return r.errorf(line, "%s can't be used while showing a view", name)
+	}
+	return nil
+}
+
+// objectArg checks a builtin was called with the right number of arguments, and
+// that the one at index is an object
+func (r *scriptRun) objectArg(line int, name string, args []interface{}, index int, count int) (*Object, error) {
+	if len(args) != count {
+		return nil, r.errorf(line, "%s takes %d arguments", name, count)
+	}
+	obj, ok := args[index].(*Object)
+	if !ok || !r.world.Contains(obj) {
+		return nil, r.errorf(line, "argument %d of %s must be an object, not %s", index+1, name, scriptTypeName(args[index]))
+	}
+	return obj, nil
+}
+
+func (e *builtinCallExpr) eval(r *scriptRun) (interface{}, error) {
+	args, err := r.evalArgs(e.args)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.step(e.at); err != nil {
+		return nil, err
+	}
+	return scriptBuiltins[e.name](r, e.at, args)
+}
+
+type unaryExpr struct {
+	scriptPos
+	op string
+	x  scriptExpr
+}
+
+func (e *unaryExpr) eval(r *scriptRun) (interface{}, error) {
+	value, err := e.x.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "not" {
+		return !scriptTruthy(value), nil
+	}
+	switch v := value.(type) {
+	case int:
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+	return nil, r.errorf(e.at, "can't negate %s", scriptTypeName(value))
+}
+
+// logicalExpr is "and" or "or", which only evaluate their right side if they need to
+type logicalExpr struct {
+	op    string
+	left  scriptExpr
+	right scriptExpr
+}
+
+func (e *logicalExpr) eval(r *scriptRun) (interface{}, error) {
+	left, err := e.left.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	if scriptTruthy(left) == (e.op == "or") {
+		return left, nil
+	}
+	return e.right.eval(r)
+}
+
+type binaryExpr struct {
+	scriptPos
+	op    string
+	left  scriptExpr
+	right scriptExpr
+}
+
+func (e *binaryExpr) eval(r *scriptRun) (interface{}, error) {
+	left, err := e.left.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.eval(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return r.equal(e.at, left, right)
+	case "!=":
+		equal, err := r.equal(e.at, left, right)
+		return !equal, err
+	}
+
+	if e.op == "+" {
+		if l, ok := left.(string); ok {
+			if r2, ok := right.(string); ok {
+				if len(l)+len(r2) > MaxScriptStringLength {
+					return nil, r.limitf(e.at, "strings can't be longer than %d", MaxScriptStringLength)
+				}
+				if err := r.copied(e.at, len(l)+len(r2)); err != nil {
+					return nil, err
+				}
+				return l + r2, nil
+			}
+		}
+		if l, ok := left.([]interface{}); ok {
+			if r2, ok := right.([]interface{}); ok {
+				if len(l)+len(r2) > MaxScriptListLength {
+					return nil, r.limitf(e.at, "lists can't be longer than %d", MaxScriptListLength)
+				}
+				if err := r.copied(e.at, len(l)+len(r2)); err != nil {
+					return nil, err
+				}
+				return append(append([]interface{}(nil), l...), r2...), nil
+			}
+		}
+	}
+
+	if l, ok := left.(string); ok {
+		if r2, ok := right.(string); ok {
+			switch e.op {
+			case "<":
+				return l < r2, nil
+			case "<=":
+				return l <= r2, nil
+			case ">":
+				return l > r2, nil
+			case ">=":
+				return l >= r2, nil
+			}
+		}
+	}
+
+	li, lIsInt := left.(int)
+	ri, rIsInt := right.(int)
+	if lIsInt && rIsInt {
+		switch e.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/", "%":
+			if ri == 0 {
+				return nil, r.errorf(e.at, "division by zero")
+			}
+			if e.op == "/" {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, lIsNum := scriptNumber(left)
+	rf, rIsNum := scriptNumber(right)
+	if lIsNum && rIsNum {
+		switch e.op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			if rf == 0 {
+				return nil, r.errorf(e.at, "division by zero")
+			}
+			return lf / rf, nil
+		case "<":
+			return lf < rf, nil
+		case "<=":
+			return lf <= rf, nil
+		case ">":
+			return lf > rf, nil
+		case ">=":
+			return lf >= rf, nil
+		}
+	}
+
+	return nil, r.errorf(e.at, "can't use %s with %s and %s", e.op, scriptTypeName(left), scriptTypeName(right))
+}
+
+// lexing
+
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenOp
+)
+
+type scriptToken struct {
+	kind   int
+	text   string
+	value  interface{}
+	line   int
+	column int
+	// set if this is the first token on its line
+	newline bool
+}
+
+var scriptOps = []string{"==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "<", ">", "=", "(", ")", "{", "}", "[", "]", ",", ".", ";"}
+
+func lexScript(source string) ([]*scriptToken, error) {
+	tokens := make([]*scriptToken, 0)
+	line, column := 1, 1
+	newline := true
+	syntaxError := func(format string, args ...interface{}) error {
+		return &ScriptError{Line: line, Column: column, Message: fmt.Sprintf(format, args...), Err: ErrScriptSyntax}
+	}
+	advance := func(n int) {
+		for _, r := range source[:n] {
+			if r == '\n' {
+				line++
+				column = 1
+			} else {
+				column++
+			}
+		}
+		source = source[n:]
+	}
+
+	for len(source) > 0 {
+		r, size := utf8.DecodeRuneInString(source)
+		if r == '\n' {
+			newline = true
+		}
+		if unicode.IsSpace(r) {
+			advance(size)
+			continue
+		}
+		if r == '#' {
+			end := strings.IndexByte(source, '\n')
+			if end < 0 {
+				end = len(source)
+			}
+			advance(end)
+			continue
+		}
+
+		token := &scriptToken{line: line, column: column, newline: newline}
+		newline = false
+		length := 0
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+			for length < len(source) {
+				r, size := utf8.DecodeRuneInString(source[length:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				length += size
+			}
+			token.kind = tokenIdent
+			token.text = source[:length]
+		case r >= '0' && r <= '9':
+			for length < len(source) && (source[length] >= '0' && source[length] <= '9' || source[length] == '.') {
+				length++
+			}
+			token.text = source[:length]
+			if strings.Contains(token.text, ".") {
+				f, err := strconv.ParseFloat(token.text, 64)
+				if err != nil {
+					return nil, syntaxError("bad number %q", token.text)
+				}
+				token.kind, token.value = tokenFloat, f
+			} else {
+				i, err := strconv.Atoi(token.text)
+				if err != nil {
+					return nil, syntaxError("bad number %q", token.text)
+				}
+				token.kind, token.value = tokenInt, i
+			}
+		case r == '"':
+			var str strings.Builder
+			length = 1
+			closed := false
+			for length < len(source) {
+				c := source[length]
+				if c == '"' {
+					length++
+					closed = true
+					break
+				}
+				if c == '\n' {
+					break
+				}
+				if c == '\\' && length+1 < len(source) {
+					switch source[length+1] {
+					case 'n':
+						str.WriteByte('\n')
+					case 't':
+						str.WriteByte('\t')
+					case '"', '\\':
+						str.WriteByte(source[length+1])
+					default:
+						return nil, syntaxError("unknown escape \\%c", source[length+1])
+					}
+					length += 2
+					continue
+				}
+				str.WriteByte(c)
+				length++
+			}
+			if !closed {
+				return nil, syntaxError("unterminated string")
+			}
+			token.kind, token.value, token.text = tokenString, str.String(), source[:length]
+		default:
+			for _, op := range scriptOps {
+				if strings.HasPrefix(source, op) {
+					token.kind, token.text = tokenOp, op
+					length = len(op)
+					break
+				}
+			}
+			if length == 0 {
+				return nil, syntaxError("unexpected %q", r)
+			}
+		}
+		tokens = append(tokens, token)
+		advance(length)
+	}
+	return append(tokens, &scriptToken{kind: tokenEOF, text: "end of script", line: line, column: column, newline: true}), nil
+}
+
+// parsing
+
+var scriptKeywords = map[string]bool{"let": true, "if": true, "else": true, "while": true, "for": true, "in": true, "return": true,
+	"true": true, "false": true, "nil": true, "and": true, "or": true, "not": true}
+
+type scriptParser struct {
+	tokens []*scriptToken
+	pos    int
+}
+
+func (p *scriptParser) peek() *scriptToken {
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() *scriptToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *scriptParser) is(text string) bool {
+	token := p.peek()
+	return (token.kind == tokenOp || token.kind == tokenIdent) && token.text == text
+}
+
+func (p *scriptParser) errorf(token *scriptToken, format string, args ...interface{}) error {
+	return &ScriptError{Line: token.line, Column: token.column, Message: fmt.Sprintf(format, args...), Err: ErrScriptSyntax}
+}
+
+func (p *scriptParser) expect(text string) (*scriptToken, error) {
+	if !p.is(text) {
+		return nil, p.errorf(p.peek(), "expected %q but found %q", text, p.peek().text)
+	}
+	return p.next(), nil
+}
+
+func (p *scriptParser) ident() (*scriptToken, error) {
+	token := p.peek()
+	if token.kind != tokenIdent || scriptKeywords[token.text] {
+		return nil, p.errorf(token, "expected a name but found %q", token.text)
+	}
+	return p.next(), nil
+}
+
+func (p *scriptParser) statements(done func(*scriptToken) bool) ([]scriptStmt, error) {
+	stmts := make([]scriptStmt, 0)
+	for !done(p.peek()) {
+		if p.peek().kind == tokenEOF {
+			return nil, p.errorf(p.peek(), "unexpected end of script")
+		}
+		if p.is(";") {
+			p.next()
+			continue
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+func (p *scriptParser) block() ([]scriptStmt, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	stmts, err := p.statements(func(t *scriptToken) bool { return t.kind == tokenOp && t.text == "}" })
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	return stmts, nil
+}
+
+func (p *scriptParser) statement() (scriptStmt, error) {
+	start := p.peek()
+	pos := scriptPos{at: start.line}
+	switch {
+	case p.is("let"):
+		p.next()
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("="); err != nil {
+			return nil, err
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &letStmt{scriptPos: pos, name: name.text, value: value}, nil
+	case p.is("if"):
+		return p.ifStatement()
+	case p.is("while"):
+		p.next()
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStmt{scriptPos: pos, cond: cond, body: body}, nil
+	case p.is("for"):
+		p.next()
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		list, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &forStmt{scriptPos: pos, name: name.text, list: list, body: body}, nil
+	case p.is("return"):
+		p.next()
+		// a value must start on the same line as the return
+		if next := p.peek(); next.newline || p.is("}") || p.is(";") {
+			return &returnStmt{scriptPos: pos}, nil
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &returnStmt{scriptPos: pos, value: value}, nil
+	}
+
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.is("=") {
+		token := p.next()
+		switch expr.(type) {
+		case *variableExpr, *memberExpr, *indexExpr:
+		default:
+			return nil, p.errorf(token, "can't assign to that")
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{scriptPos: pos, target: expr, value: value}, nil
+	}
+	return &exprStmt{scriptPos: pos, expr: expr}, nil
+}
+
+func (p *scriptParser) ifStatement() (scriptStmt, error) {
+	start := p.next()
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ifStmt{scriptPos: scriptPos{at: start.line}, cond: cond, then: then}
+	if p.is("else") {
+		p.next()
+		if p.is("if") {
+			elseIf, err := p.ifStatement()
+			if err != nil {
+				return nil, err
+			}
+			stmt.otherwise = []scriptStmt{elseIf}
+		} else if stmt.otherwise, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// binary operators from loosest to tightest binding
+var scriptPrecedence = [][]string{
+	{"or"},
+	{"and"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *scriptParser) expression() (scriptExpr, error) {
+	return p.binary(0)
+}
+
+func (p *scriptParser) binary(level int) (scriptExpr, error) {
+	if level == len(scriptPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		if (token.kind != tokenOp && token.kind != tokenIdent) || !containsString(scriptPrecedence[level], token.text) {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if token.text == "and" || token.text == "or" {
+			left = &logicalExpr{op: token.text, left: left, right: right}
+		} else {
+			left = &binaryExpr{scriptPos: scriptPos{at: token.line}, op: token.text, left: left, right: right}
+		}
+	}
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	if p.is("not") || p.is("-") {
+		token := p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{scriptPos: scriptPos{at: token.line}, op: token.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *scriptParser) args() ([]scriptExpr, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	return p.list(")")
+}
+
+// list parses comma separated expressions up to and including end
+func (p *scriptParser) list(end string) ([]scriptExpr, error) {
+	exprs := make([]scriptExpr, 0)
+	for !p.is(end) {
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.is(end) {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.next()
+	return exprs, nil
+}
+
+func (p *scriptParser) postfix() (scriptExpr, error) {
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			pos := scriptPos{at: name.line}
+			if p.is("(") && !p.peek().newline {
+				args, err := p.args()
+				if err != nil {
+					return nil, err
+				}
+				expr = &methodCallExpr{scriptPos: pos, obj: expr, method: name.text, args: args}
+			} else {
+				expr = &memberExpr{scriptPos: pos, obj: expr, name: name.text}
+			}
+		case p.is("[") && !p.peek().newline:
+			token := p.next()
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &indexExpr{scriptPos: scriptPos{at: token.line}, list: expr, index: index}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	token := p.peek()
+	switch token.kind {
+	case tokenInt, tokenFloat, tokenString:
+		p.next()
+		return &literalExpr{value: token.value}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			p.next()
+			return &literalExpr{value: true}, nil
+		case "false":
+			p.next()
+			return &literalExpr{value: false}, nil
+		case "nil":
+			p.next()
+			return &literalExpr{value: nil}, nil
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if p.is("(") && !p.peek().newline {
+			if _, ok := scriptBuiltins[name.text]; !ok {
+				return nil, p.errorf(name, "unknown function %s", name.text)
+			}
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			return &builtinCallExpr{scriptPos: scriptPos{at: name.line}, name: name.text, args: args}, nil
+		}
+		return &variableExpr{scriptPos: scriptPos{at: name.line}, name: name.text}, nil
+	case tokenOp:
+		switch token.text {
+		case "(":
+			p.next()
+			expr, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		case "[":
+			p.next()
+			elements, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listExpr{elements: elements}, nil
+		}
+	}
+	return nil, p.errorf(token, "unexpected %q", token.text)
+}
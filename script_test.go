@@ -0,0 +1,225 @@
+package muddy_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pgm/muddy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptMethods(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+
+	Tunnel := basic.Thing.Subclass("Tunnel").
+		AddTypedProperty("uses", muddy.IntType, 0).
+		AddScriptMethod("Crawl", nil, `
+			# only small players fit
+			if player.size > 3 {
+				fail("you don't fit")
+			}
+			tell(player, "You squeeze through the " + self.name)
+			self.uses = self.uses + 1
+			move(player, self.destination)
+		`).
+		AddScriptMethod("count", []string{"words"}, `
+			let total = 0
+			for word in words {
+				total = total + len(word)
+			}
+			return total
+		`)
+	world.RegisterClass(Tunnel)
+	tunnel := world.AddObject(tiny.Castle, Tunnel).Set("name", "tunnel").Set("destination", tiny.Beach)
+
+	joe.Set("size", 5)
+	_, err := tunnel.TryCall(ctx, "Crawl")
+	assert.EqualError(t, err, "you don't fit")
+	assert.Equal(t, tiny.Castle, joe.Parent())
+
+	joe.Set("size", 2)
+	tunnel.Call(ctx, "Crawl")
+	assert.Equal(t, tiny.Beach, joe.Parent())
+	assert.Equal(t, 1, tunnel.Get("uses"))
+	assert.Equal(t, []string{"You squeeze through the tunnel"}, joe.Call(ctx, "getMessages"))
+
+	// scripts see Go return values as lists, and get the same arity checks
+	assert.Equal(t, 8, tunnel.Call(ctx, "count", []string{"abc", "defgh"}))
+	_, err = tunnel.TryCall(ctx, "count")
+	assert.True(t, errors.Is(err, muddy.ErrBadArity))
+
+	// property schemas still apply
+	_, err = tunnel.SetScript("Break", nil, `self.uses = "lots"`).TryCall(ctx, "Break")
+	assert.True(t, errors.Is(err, muddy.ErrWrongType))
+	assert.Equal(t, 1, tunnel.Get("uses"))
+}
+
+func TestScriptOnObject(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+	bell := basic.AddItem(tiny.Castle, "bell")
+	rock := basic.AddItem(tiny.Castle, "rock")
+
+	bell.SetScript("Ring", nil, `
+		for obj in children(parent(self)) {
+			if is(obj, "Player") {
+				tell(obj, "Ding!")
+			}
+		}
+		return str(len(self.getActions()))
+	`)
+	assert.True(t, bell.HasMethod("Ring"))
+	assert.False(t, rock.HasMethod("Ring"))
+	bell.Call(ctx, "Ring")
+	assert.Equal(t, []string{"Ding!"}, joe.Call(ctx, "getMessages"))
+
+	// per-object scripts are part of the world's state
+	rebuilt := world.Clone()
+	assert.True(t, rebuilt.GetObject(bell.ID).HasMethod("Ring"))
+	data, err := world.MarshalSnapshot()
+	assert.Nil(t, err)
+	restored := muddy.NewWorldBasics(muddy.NewWorld())
+	assert.Nil(t, restored.UnmarshalSnapshot(data))
+	restored.World.GetObject(bell.ID).Call(&muddy.Context{}, "Ring")
+	assert.Equal(t, []string{"Ding!", "Ding!"}, restored.World.GetObject(joe.ID).Call(ctx, "getMessages"))
+
+	bell.SetScript("Ring", nil, "")
+	assert.False(t, bell.HasMethod("Ring"))
+	assert.True(t, rebuilt.GetObject(bell.ID).HasMethod("Ring"))
+
+	// they override the class's methods, and can call the ones they don't override
+	rock.SetScript("getName", nil, `return "a " + self.name`)
+	assert.Equal(t, "a rock", rock.Call(ctx, "getName"))
+	rock.SetScript("describe", nil, `return self.getName() + "!"`)
+	assert.Equal(t, "a rock!", rock.Call(ctx, "describe"))
+}
+
+func TestScriptErrors(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+	rock := basic.AddItem(tiny.Castle, "rock")
+
+	err := rock.TrySetScript("Bad", nil, "let x = \n  (1 + ")
+	var scriptErr *muddy.ScriptError
+	assert.True(t, errors.As(err, &scriptErr))
+	assert.True(t, errors.Is(err, muddy.ErrScriptSyntax))
+	assert.Equal(t, 2, scriptErr.Line)
+	assert.False(t, rock.HasMethod("Bad"))
+
+	run := func(source string) error {
+		rock.SetScript("Run", nil, source)
+		_, err := rock.TryCall(ctx, "Run")
+		return err
+	}
+	assert.True(t, errors.Is(run("while true { }"), muddy.ErrScriptLimit))
+	assert.True(t, errors.Is(run("self.Run()"), muddy.ErrScriptLimit))
+	assert.True(t, errors.Is(run(`let s = "aa"
+		while true { s = s + s }`), muddy.ErrScriptLimit))
+	assert.True(t, errors.Is(run("return 1 / 0"), muddy.ErrScriptRuntime))
+	assert.True(t, errors.Is(run("return undefined"), muddy.ErrScriptRuntime))
+	assert.True(t, errors.Is(run("self.nonexistent()"), muddy.ErrNoSuchMethod))
+	assert.True(t, errors.Is(run("move(self, self)"), muddy.ErrScriptRuntime))
+
+	// timers can't be too far off, or too many
+	assert.True(t, errors.Is(run(`after(-1, self, "Run")`), muddy.ErrScriptRuntime))
+	assert.True(t, errors.Is(run(`after(100000000000, self, "Run")`), muddy.ErrScriptRuntime))
+	assert.True(t, errors.Is(run(`
+		let i = 0
+		while i <= 100 {
+			after(60, self, "Run")
+			i = i + 1
+		}
+	`), muddy.ErrScriptLimit))
+	assert.Equal(t, muddy.MaxScriptTimers, world.Scheduler.Pending())
+
+	// lists which share elements can be much bigger than the steps it took to
+	// build them, so walking them uses up steps too
+	doubled := `
+		let l = [1]
+		let i = 0
+		while i < 40 {
+			l = [l, l]
+			i = i + 1
+		}
+	`
+	for _, use := range []string{"return str(l)", "return l == l", "self.x = l", "return l", "tell(player, l)"} {
+		assert.True(t, errors.Is(run(doubled+use), muddy.ErrScriptLimit), use)
+	}
+	assert.True(t, errors.Is(run(`
+		let s = "a"
+		while len(s) < 65536 { s = s + s }
+		let l = []
+		while len(l) < 100 { l = append(l, s) }
+		return str(l)
+	`), muddy.ErrScriptLimit))
+
+	// the budget is for each call from Go, not for the lifetime of the world
+	rock.SetScript("Count", nil, `
+		let i = 0
+		while i < 1000 { i = i + 1 }
+		return i
+	`)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, 1000, rock.Call(ctx, "Count"))
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	rock := basic.AddItem(basic.Lobby, "rock")
+	ctx := &muddy.Context{World: basic.World}
+
+	// scripts which have been pushed out of the cache are parsed again when they're needed
+	rock.SetScript("first", nil, "return 1")
+	for i := 0; i <= muddy.MaxCachedScripts; i++ {
+		rock.SetScript("other", nil, fmt.Sprintf("return %d", i+2))
+	}
+	assert.Equal(t, 1, rock.Call(ctx, "first"))
+	assert.Equal(t, muddy.MaxCachedScripts+2, rock.Call(ctx, "other"))
+}
+
+func TestScriptViewGetters(t *testing.T) {
+	basic := muddy.NewWorldBasics(muddy.NewWorld())
+	world := basic.World
+	tiny := NewTinyland(basic)
+	joe := basic.AddPlayer("joe", tiny.Castle)
+	ctx := &muddy.Context{Player: joe, World: world}
+	sphinx := basic.AddPuzzle(tiny.Castle, "sphinx", "Riddles", []string{"Four legs?", "Two legs?"}, []string{"dog", "man"})
+
+	// scripts return lists of any values, rather than what the Go methods declare.
+	// Views use what they can and ignore the rest.
+	tiny.Castle.SetScript("getExits", nil, `
+		let exits = []
+		for obj in children(self) {
+			if is(obj, "Exit") {
+				exits = append(exits, obj)
+			}
+		}
+		return append(exits, "not an exit")
+	`)
+	joe.SetScript("getMessages", nil, `return ["hello", 42]`)
+	joe.SetScript("getInventory", nil, `return 7`)
+	sphinx.SetScript("getQuestions", nil, `return ["Four legs?", 4]`)
+	sphinx.SetScript("checkAnswers", []string{"guesses"}, `return [true, "yes"]`)
+	sphinx.Call(ctx, "Solve")
+	joe.Call(ctx, "submitForm", joe.Call(ctx, "getModal"), []string{"dog", "cat"})
+
+	view := world.GetView(joe.ID)
+	assert.Equal(t, []string{"Beach", "Taco Stand"}, sectionLabels(view, "exits"))
+	assert.Equal(t, []string{"hello", ""}, sectionLabels(view, "messages"))
+	assert.Equal(t, []string{}, sectionLabels(view, "inventory"))
+	assert.Equal(t, "", view.Modal.Form.Rows[1].Caption)
+	assert.True(t, view.Modal.Form.Rows[0].Correct)
+	assert.False(t, view.Modal.Form.Rows[1].Correct)
+}
@@ -17,20 +17,25 @@ import (
 
 // I WISH IT WOULD BE HALLOWEEN 5-EVER!!!!!!
 type Universe struct {
-	clientIDCounter         uint32
-	events                  chan interface{}
-	worlds                  map[string]*WorldBasics
-	clients                 map[int]*Client
-	clientCountPerSessionID map[string]int
-	worldBuilder            func() *WorldBasics
+	clientIDCounter uint32
+	events          chan interface{}
+	worlds          map[string]*WorldBasics
+	clients         map[int]*Client
+	// every session which has ever connected, so that extra tabs and reconnects
+	// get the same player
+	sessions     map[sessionKey]*ClientSession
+	worldBuilder func() *WorldBasics
+	// most recent snapshot of each world, so that clients can be resynced without waiting for an event
+	snapshots map[string]*World
 }
 
 func newUniverse(worldBuilder func() *WorldBasics) *Universe {
 	return &Universe{events: make(chan interface{}),
-		worlds:                  make(map[string]*WorldBasics),
-		clients:                 make(map[int]*Client),
-		clientCountPerSessionID: make(map[string]int),
-		worldBuilder:            worldBuilder,
+		worlds:       make(map[string]*WorldBasics),
+		clients:      make(map[int]*Client),
+		sessions:     make(map[sessionKey]*ClientSession),
+		worldBuilder: worldBuilder,
+		snapshots:    make(map[string]*World),
 	}
 }
 
@@ -52,43 +57,76 @@ func (universe *Universe) eventLoop() {
 			if !worldExists {
 				log.Printf("Creating world %s", e.client.worldID)
 				world = universe.worldBuilder()
+				worldID := e.client.worldID
+				world.World.ID = worldID
+				// the universe blocks sending events to the world, so the world must never
+				// block sending back to the universe or the two can deadlock.
+				//
+				// worlds are kept for as long as the server runs, so players who leave
+				// can come back to them later
+				toUniverse := forwardEvents(universe.events)
 				go world.eventLoop(func(w *World) {
-					universe.events <- &NewSnapshotEvent{snapshot: w, worldID: e.client.worldID}
+					toUniverse <- &NewSnapshotEvent{snapshot: w, worldID: worldID}
+				}, func(sessionID string, err error) {
+					toUniverse <- &PlayerErrorEvent{worldID: worldID, sessionID: sessionID, err: err}
 				})
 				universe.worlds[e.client.worldID] = world
 			}
 
-			existingClientCount := universe.clientCountPerSessionID[e.client.sessionID]
-			if existingClientCount == 0 {
+			key := sessionKey{worldID: e.client.worldID, sessionID: e.client.sessionID}
+			session, sessionExists := universe.sessions[key]
+			if !sessionExists {
 				log.Printf("Creating new sesion %s", e.client.sessionID)
 				playerIDChan := make(chan int)
 				log.Printf("Sending to %v", world.events)
 				world.events <- &NewPlayerEvent{sessionID: e.client.sessionID, playerIDChan: playerIDChan}
 				log.Printf("Waiting for player ID")
-				playerID := <-playerIDChan
-				e.client.playerID = playerID
-				log.Printf("Session %s is associated with player %d", e.client.sessionID, e.client.playerID)
+				session = &ClientSession{playerID: <-playerIDChan}
+				universe.sessions[key] = session
+			} else if session.clientCount == 0 {
+				log.Printf("Session %s reconnected", e.client.sessionID)
+				world.events <- &ReconnectedPlayerEvent{sessionID: e.client.sessionID}
+			} else if snapshot := universe.snapshots[e.client.worldID]; snapshot != nil {
+				// another tab for a session which is already connected. Nothing changes in
+				// the world, so send it the latest snapshot rather than waiting for an event
+				e.client.sendSnapshot(&PlayerSnapshot{snapshot: snapshot, playerID: session.playerID})
 			}
-			universe.clientCountPerSessionID[e.client.sessionID] = existingClientCount + 1
+			e.client.playerID = session.playerID
+			session.clientCount++
+			log.Printf("Session %s is associated with player %d (%d clients)", e.client.sessionID, e.client.playerID, session.clientCount)
 
 		case *ClientDisconnectEvent:
 			log.Printf("Disconnected client (%d)", e.client.ID)
 			world := universe.worlds[e.client.worldID]
-			existingClientCount := universe.clientCountPerSessionID[e.client.sessionID] - 1
-			if existingClientCount == 0 {
+			session := universe.sessions[sessionKey{worldID: e.client.worldID, sessionID: e.client.sessionID}]
+			session.clientCount--
+			if session.clientCount == 0 {
+				// the last tab for this session has gone
 				world.events <- &DisconnectedPlayerEvent{e.client.sessionID}
-				log.Printf("Disconnected player (%d)", e.client.ID)
+				log.Printf("Disconnected player (%d)", session.playerID)
 			}
-			universe.clientCountPerSessionID[e.client.sessionID] = existingClientCount
 			delete(clients, e.client.ID)
 
 		case *ClientMessageEvent:
-			handleMessage(e.client.sessionID, universe.worlds[e.client.worldID], e.message)
+			handleMessage(universe, e.client, e.message)
+
+		case *PlayerErrorEvent:
+			message, err := json.Marshal(&ErrorMessage{Error: e.err.Error()})
+			if err != nil {
+				log.Printf("failed to marshal error: %v", err)
+				break
+			}
+			for _, client := range clients {
+				if e.worldID == client.worldID && e.sessionID == client.sessionID {
+					client.send <- message
+				}
+			}
 
 		case *NewSnapshotEvent:
+			universe.snapshots[e.worldID] = e.snapshot
 			for _, client := range clients {
 				if e.worldID == client.worldID {
-					client.snapshotChan <- &PlayerSnapshot{snapshot: e.snapshot, playerID: client.playerID}
+					client.sendSnapshot(&PlayerSnapshot{snapshot: e.snapshot, playerID: client.playerID})
 				}
 			}
 		}
@@ -99,16 +137,110 @@ func (universe *Universe) eventLoop() {
 	}
 }
 
+// how many events forwardEvents queues before it starts warning that out is falling behind
+const forwardQueueWarning = 1000
+
+// forwardEvents returns a channel which never blocks for long. Everything sent to
+// it is passed on to out in order, queueing as many events as necessary while
+// out is busy. Close the returned channel to stop forwarding: anything still
+// queued is sent and then the goroutine doing the forwarding exits.
+func forwardEvents(out chan<- interface{}) chan<- interface{} {
+	in := make(chan interface{})
+	go func() {
+		var queue []interface{}
+		for in != nil || len(queue) > 0 {
+			// a nil channel blocks forever, so only try to send when there's something queued
+			var send chan<- interface{}
+			var next interface{}
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+			select {
+			case event, ok := <-in:
+				if !ok {
+					in = nil
+					break
+				}
+				queue = append(queue, event)
+				if len(queue)%forwardQueueWarning == 0 {
+					log.Printf("%d events are waiting to be forwarded", len(queue))
+				}
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return in
+}
+
 type ClientMessage struct {
 	ObjectID *int     `json:"objectID"`
 	Method   *string  `json:"method"`
 	Args     []string `json:"args"`
+	// ask for the full view to be sent again instead of a diff
+	Resync bool `json:"resync"`
+	// choose the player's display name
+	Name *string `json:"name"`
+	// chat. Whispers go to the player whose ID is in To
+	Say     *string `json:"say"`
+	Shout   *string `json:"shout"`
+	Whisper *string `json:"whisper"`
+	To      *int    `json:"to"`
+	// answers to the form modal with this ID, one per row
+	Form    *int     `json:"form"`
+	Guesses []string `json:"guesses"`
+	// close the modal with this ID, either by dismissing it or saying you're done with it
+	Dismiss *int `json:"dismiss"`
+	Done    *int `json:"done"`
+	// the token which makes the session's player a builder. It's sent as a message
+	// rather than in the URL so that it doesn't end up in logs or history.
+	Builder *string `json:"builder"`
+}
+
+// ErrorMessage is sent to a client when something it asked for failed
+type ErrorMessage struct {
+	Error string `json:"error"`
 }
 
-func handleMessage(sessionID string, world *WorldBasics, messageJSON []byte) {
+func handleMessage(universe *Universe, client *Client, messageJSON []byte) {
+	sessionID := client.sessionID
+	world := universe.worlds[client.worldID]
+
 	var message ClientMessage
 	if err := json.Unmarshal(messageJSON, &message); err != nil {
 		log.Printf("failed to unmarshal: %v", err)
+	} else if message.Resync {
+		snapshot := universe.snapshots[client.worldID]
+		if snapshot == nil {
+			log.Printf("No snapshot of world %s to resync from", client.worldID)
+		} else {
+			log.Printf("Resyncing client (%d)", client.ID)
+			client.sendSnapshot(&PlayerSnapshot{snapshot: snapshot, playerID: client.playerID, resync: true})
+		}
+	} else if message.Name != nil {
+		log.Printf("sending name to world (sessionID: %s, name: %s)", sessionID, *message.Name)
+		world.events <- &SetNameEvent{sessionID: sessionID, name: *message.Name}
+	} else if message.Form != nil {
+		log.Printf("sending form submission to world (sessionID: %s, form: %d, %d guesses)", sessionID, *message.Form, len(message.Guesses))
+		world.events <- &FormSubmitEvent{sessionID: sessionID, modalID: *message.Form, guesses: message.Guesses}
+	} else if message.Builder != nil {
+		log.Printf("sending builder token to world (sessionID: %s)", sessionID)
+		world.events <- &BuilderEvent{sessionID: sessionID, token: *message.Builder}
+	} else if message.Dismiss != nil {
+		world.events <- &CloseModalEvent{sessionID: sessionID, modalID: *message.Dismiss, outcome: "dismiss"}
+	} else if message.Done != nil {
+		world.events <- &CloseModalEvent{sessionID: sessionID, modalID: *message.Done, outcome: "done"}
+	} else if message.Say != nil {
+		world.events <- &ChatEvent{sessionID: sessionID, mode: "say", text: *message.Say}
+	} else if message.Shout != nil {
+		world.events <- &ChatEvent{sessionID: sessionID, mode: "shout", text: *message.Shout}
+	} else if message.Whisper != nil {
+		if message.To == nil {
+			log.Printf("Whisper without a recipient (message: %s)", messageJSON)
+		} else {
+			world.events <- &ChatEvent{sessionID: sessionID, mode: "whisper", text: *message.Whisper, recipientID: *message.To}
+		}
 	} else {
 		if message.ObjectID == nil || message.Method == nil {
 			log.Printf("Required field on message was missing (message: %s)", messageJSON)
@@ -192,7 +324,7 @@ func serveWs(universe *Universe, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	clientID := int(atomic.AddUint32(&universe.clientIDCounter, 1))
-	client := &Client{ID: clientID, universe: universe, conn: conn, send: make(chan []byte, 256), snapshotChan: make(chan *PlayerSnapshot), sessionID: sessionID, worldID: worldID}
+	client := &Client{ID: clientID, universe: universe, conn: conn, send: make(chan []byte, 256), snapshotChan: make(chan *PlayerSnapshot, 1), sessionID: sessionID, worldID: worldID}
 	go inboundMessageLoop(client)
 	go outboundMessageLoop(client)
 
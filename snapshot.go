@@ -0,0 +1,252 @@
+package muddy
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Snapshots record the state of every object in a world: its ID, class, place in
+// the parent/child tree and properties. Methods are closures and can't be saved,
+// so when a snapshot is loaded each object is bound to the ClassDef registered
+// on the world under the same name.
+
+const snapshotVersion = 1
+
+type snapshotJSON struct {
+	Version int               `json:"version"`
+	NextID  int               `json:"nextID"`
+	Objects []*objectSnapshot `json:"objects"`
+}
+
+type objectSnapshot struct {
+	ID         int                       `json:"id"`
+	Class      string                    `json:"class"`
+	Parent     *int                      `json:"parent"`
+	Children   []int                     `json:"children"`
+	Properties map[string]*valueSnapshot `json:"properties"`
+}
+
+// property values are tagged with their type so that they come back exactly
+// as they went in (ie: ints don't turn into float64s)
+type valueSnapshot struct {
+	Type  string           `json:"type"`
+	Value json.RawMessage  `json:"value,omitempty"`
+	List  []*valueSnapshot `json:"list,omitempty"`
+}
+
+// RegisterClass makes a class available for loading snapshots. Each class must
+// have a unique name within a world.
+func (w *World) RegisterClass(classDef *ClassDef) *ClassDef {
+	if existing, ok := w.classes[classDef.Name]; ok && existing != classDef {
+		panic(fmt.Sprintf("A different class named \"%s\" is already registered", classDef.Name))
+	}
+	w.classes[classDef.Name] = classDef
+	return classDef
+}
+
+func (w *World) MarshalSnapshot() ([]byte, error) {
+	snapshot := &snapshotJSON{Version: snapshotVersion, NextID: w.nextID, Objects: make([]*objectSnapshot, 0, w.objects.count)}
+	var err error
+	w.objects.each(func(ID int, state *objectState) {
+		if err != nil {
+			return
+		}
+		if w.classes[state.classDef.Name] != state.classDef {
+			err = fmt.Errorf("object %d is an instance of class \"%s\" which is not registered with the world", ID, state.classDef.Name)
+			return
+		}
+
+		objSnapshot := &objectSnapshot{ID: ID, Class: state.classDef.Name, Children: append([]int{}, state.childIDs...),
+			Properties: make(map[string]*valueSnapshot)}
+		if state.parentID != 0 {
+			parentID := state.parentID
+			objSnapshot.Parent = &parentID
+		}
+		for name, value := range state.properties {
+			encoded, encodeErr := encodeValue(value)
+			if encodeErr != nil {
+				err = fmt.Errorf("object %d, property \"%s\": %v", ID, name, encodeErr)
+				return
+			}
+			objSnapshot.Properties[name] = encoded
+		}
+
+		snapshot.Objects = append(snapshot.Objects, objSnapshot)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(snapshot)
+}
+
+// UnmarshalSnapshot replaces all objects in the world with those in the snapshot.
+// The world is left untouched if the snapshot can't be loaded.
+func (w *World) UnmarshalSnapshot(data []byte) error {
+	var snapshot snapshotJSON
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	states := make(map[int]*objectState)
+	for _, objSnapshot := range snapshot.Objects {
+		classDef, ok := w.classes[objSnapshot.Class]
+		if !ok {
+			return fmt.Errorf("object %d is an instance of unknown class \"%s\"", objSnapshot.ID, objSnapshot.Class)
+		}
+		if _, exists := states[objSnapshot.ID]; exists {
+			return fmt.Errorf("object %d appears more than once", objSnapshot.ID)
+		}
+		if objSnapshot.ID <= 0 || objSnapshot.ID >= snapshot.NextID {
+			return fmt.Errorf("object %d has an ID which is not between 1 and nextID (%d)", objSnapshot.ID, snapshot.NextID)
+		}
+
+		state := &objectState{gen: w.gen, classDef: classDef, childIDs: append([]int{}, objSnapshot.Children...),
+			properties: make(map[string]interface{})}
+		if objSnapshot.Parent != nil {
+			state.parentID = *objSnapshot.Parent
+		}
+		for name, encoded := range objSnapshot.Properties {
+			value, err := decodeValue(encoded)
+			if err != nil {
+				return fmt.Errorf("object %d, property \"%s\": %v", objSnapshot.ID, name, err)
+			}
+			if schema, ok := classDef.propertySchemas[name]; ok {
+				if detail, err := schema.check(value); err != nil {
+					return &PropertyError{ObjectID: objSnapshot.ID, Name: name, Err: err, Detail: detail}
+				}
+			}
+			state.properties[name] = value
+		}
+		states[objSnapshot.ID] = state
+	}
+
+	// make sure the parent and child links agree with each other
+	for ID, state := range states {
+		if state.parentID != 0 {
+			parent, ok := states[state.parentID]
+			if !ok {
+				return fmt.Errorf("object %d has unknown parent %d", ID, state.parentID)
+			}
+			if !containsID(parent.childIDs, ID) {
+				return fmt.Errorf("object %d has parent %d, but is not one of its children", ID, state.parentID)
+			}
+		}
+		for _, childID := range state.childIDs {
+			child, ok := states[childID]
+			if !ok {
+				return fmt.Errorf("object %d has unknown child %d", ID, childID)
+			}
+			if child.parentID != ID {
+				return fmt.Errorf("object %d lists %d as a child, but its parent is not %d", ID, childID, ID)
+			}
+		}
+	}
+
+	var objects objectTable
+	for ID, state := range states {
+		objects.set(ID, state, w.gen)
+	}
+	w.objects = objects
+	w.nextID = snapshot.NextID
+
+	// existing handles stay valid, other than those for objects which no longer exist
+	w.handles.Range(func(ID, obj interface{}) bool {
+		if _, ok := states[ID.(int)]; !ok {
+			w.handles.Delete(ID)
+		}
+		return true
+	})
+	return nil
+}
+
+func containsID(list []int, ID int) bool {
+	for _, element := range list {
+		if element == ID {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeValue(value interface{}) (*valueSnapshot, error) {
+	var typeName string
+	switch v := value.(type) {
+	case nil:
+		return &valueSnapshot{Type: "nil"}, nil
+	case string:
+		typeName = "string"
+	case int:
+		typeName = "int"
+	case bool:
+		typeName = "bool"
+	case float64:
+		typeName = "float"
+	case ObjectRef:
+		buf, err := json.Marshal(v.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &valueSnapshot{Type: "ref", Value: buf}, nil
+	case []interface{}:
+		list := make([]*valueSnapshot, len(v))
+		for i, element := range v {
+			encoded, err := encodeValue(element)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = encoded
+		}
+		return &valueSnapshot{Type: "list", List: list}, nil
+	default:
+		return nil, fmt.Errorf("can't save value of type %T", value)
+	}
+
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &valueSnapshot{Type: typeName, Value: buf}, nil
+}
+
+func decodeValue(encoded *valueSnapshot) (interface{}, error) {
+	var err error
+	switch encoded.Type {
+	case "nil":
+		return nil, nil
+	case "string":
+		var v string
+		err = json.Unmarshal(encoded.Value, &v)
+		return v, err
+	case "int":
+		var v int
+		err = json.Unmarshal(encoded.Value, &v)
+		return v, err
+	case "bool":
+		var v bool
+		err = json.Unmarshal(encoded.Value, &v)
+		return v, err
+	case "float":
+		var v float64
+		err = json.Unmarshal(encoded.Value, &v)
+		return v, err
+	case "ref":
+		var v ObjectRef
+		err = json.Unmarshal(encoded.Value, &v.ID)
+		return v, err
+	case "list":
+		list := make([]interface{}, len(encoded.List))
+		for i, element := range encoded.List {
+			list[i], err = decodeValue(element)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown value type \"%s\"", encoded.Type)
+}
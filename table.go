@@ -0,0 +1,137 @@
+package muddy
+
+import "sync/atomic"
+
+// objectTable maps object IDs to their state. It's a persistent trie with 32
+// entries per node, so copying a table is O(1): the copy shares all of its
+// nodes with the original. Each world has a generation number, and only nodes
+// (and object states) created by that generation are modified in place. Anything
+// else is copied first, so a write costs O(log N) and never affects other
+// worlds sharing the node.
+
+const tableBits = 5
+const tableWidth = 1 << tableBits
+const tableMask = tableWidth - 1
+
+var lastGeneration uint64
+
+func nextGeneration() uint64 {
+	return atomic.AddUint64(&lastGeneration, 1)
+}
+
+type tableNode struct {
+	gen      uint64
+	children [tableWidth]*tableNode
+	// only used by leaves
+	states [tableWidth]*objectState
+}
+
+type objectTable struct {
+	root *tableNode
+	// how far to shift an ID to find its index in the root node. Zero when the root is a leaf.
+	shift uint
+	count int
+}
+
+// objectState is everything about an object which can change. States are shared
+// between worlds until one of them modifies it (see Object.mutableState)
+type objectState struct {
+	gen        uint64
+	classDef   *ClassDef
+	parentID   int // zero if no parent
+	childIDs   []int
+	properties map[string]interface{} // map is mutable but values are immutable
+}
+
+func (s *objectState) copy(gen uint64) *objectState {
+	properties := make(map[string]interface{}, len(s.properties))
+	for name, value := range s.properties {
+		properties[name] = value
+	}
+	return &objectState{gen: gen, classDef: s.classDef, parentID: s.parentID,
+		childIDs: append([]int(nil), s.childIDs...), properties: properties}
+}
+
+func (t *objectTable) capacity() int {
+	return 1 << (t.shift + tableBits)
+}
+
+func (t *objectTable) get(ID int) *objectState {
+	if t.root == nil || ID < 0 || ID >= t.capacity() {
+		return nil
+	}
+	node := t.root
+	for shift := t.shift; shift > 0; shift -= tableBits {
+		node = node.children[(ID>>shift)&tableMask]
+		if node == nil {
+			return nil
+		}
+	}
+	return node.states[ID&tableMask]
+}
+
+func editableNode(node *tableNode, gen uint64) *tableNode {
+	if node == nil {
+		return &tableNode{gen: gen}
+	}
+	if node.gen == gen {
+		return node
+	}
+	newNode := *node
+	newNode.gen = gen
+	return &newNode
+}
+
+// set stores state under ID (or deletes it, if state is nil), copying any nodes
+// on the way which don't belong to generation gen
+func (t *objectTable) set(ID int, state *objectState, gen uint64) {
+	if t.root == nil {
+		t.root = &tableNode{gen: gen}
+	}
+	for ID >= t.capacity() {
+		newRoot := &tableNode{gen: gen}
+		newRoot.children[0] = t.root
+		t.root = newRoot
+		t.shift += tableBits
+	}
+
+	t.root = editableNode(t.root, gen)
+	node := t.root
+	for shift := t.shift; shift > 0; shift -= tableBits {
+		index := (ID >> shift) & tableMask
+		child := editableNode(node.children[index], gen)
+		node.children[index] = child
+		node = child
+	}
+
+	existing := node.states[ID&tableMask]
+	if existing == nil && state != nil {
+		t.count++
+	} else if existing != nil && state == nil {
+		t.count--
+	}
+	node.states[ID&tableMask] = state
+}
+
+// each calls f for every object in ascending order of ID
+func (t *objectTable) each(f func(ID int, state *objectState)) {
+	if t.root != nil {
+		eachInNode(t.root, t.shift, 0, f)
+	}
+}
+
+func eachInNode(node *tableNode, shift uint, base int, f func(ID int, state *objectState)) {
+	if shift == 0 {
+		for i, state := range node.states {
+			if state != nil {
+				f(base+i, state)
+			}
+		}
+		return
+	}
+	for i, child := range node.children {
+		if child != nil {
+			eachInNode(child, shift-tableBits, base+(i<<shift), f)
+		}
+	}
+}
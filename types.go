@@ -1,37 +1,129 @@
 package muddy
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 type Context struct {
 	Player *Object
+	// world the call is happening in. Used to resolve object IDs passed as arguments.
+	World *World
+	// shared by scripts run on behalf of the same call, to limit how much work they do
+	scriptBudget *scriptBudget
 }
 
-type MethodType func(*Object, *Context, []interface{}) interface{}
+type MethodType func(*Object, *Context, []interface{}) (interface{}, error)
+
+var ErrNoSuchMethod = errors.New("no such method")
+var ErrBadArity = errors.New("wrong number of arguments")
+var ErrBadArgument = errors.New("bad argument")
+var ErrNotAllowed = errors.New("not one of the player's actions")
+var ErrPanicked = errors.New("method panicked")
+
+// MethodError is returned when a method could not be dispatched. Use errors.Is to
+// check which of the Err* values above caused it.
+type MethodError struct {
+	ClassName string
+	Method    string
+	Err       error
+	Detail    string
+}
+
+func (e *MethodError) Error() string {
+	msg := fmt.Sprintf("could not call \"%s\" on class \"%s\": %v", e.Method, e.ClassName, e.Err)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	return msg
+}
+
+func (e *MethodError) Unwrap() error {
+	return e.Err
+}
 
 type ClassDef struct {
 	// this is an immutable class. As in, after we construct it, we
 	// promise no one will mutate it, so it's safe for multiple threads
 	// to access.
 	Name              string
+	superclass        *ClassDef
 	classNames        map[string]bool
 	methodDispatch    map[string]MethodType
 	initialProperties map[string]interface{}
+	propertySchemas   map[string]*PropertySchema
+	// what to ask the player for when a method takes a line of text from them
+	prompts map[string]string
+}
+
+func (c *ClassDef) TryCall(methodName string, obj *Object, ctx *Context, args ...interface{}) (interface{}, error) {
+	method, ok := c.methodDispatch[methodName]
+	if !ok {
+		methodNames := make([]string, 0)
+		for methodName := range c.methodDispatch {
+			methodNames = append(methodNames, methodName)
+		}
+		sort.Strings(methodNames)
+		return nil, &MethodError{ClassName: c.Name, Method: methodName, Err: ErrNoSuchMethod, Detail: fmt.Sprintf("Methods: %v", methodNames)}
+	}
+	result, err := method(obj, ctx, args)
+	if methodErr, ok := err.(*MethodError); ok && methodErr.Method == "" {
+		// the adapter doesn't know what it was registered as, so fill that in
+		methodErr.ClassName = c.Name
+		methodErr.Method = methodName
+	}
+	return result, err
 }
 
+// Call is like TryCall, but for use when the method is known to exist. Panics if it doesn't.
 func (c *ClassDef) Call(methodName string, obj *Object, ctx *Context, args ...interface{}) interface{} {
-	method := c.methodDispatch[methodName]
-	return method(obj, ctx, args)
+	result, err := c.TryCall(methodName, obj, ctx, args...)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
 
+// TryCallSuper invokes the implementation of a method that this class inherited
+// from its superclass. Use it from within an override to extend the method it replaced.
+func (c *ClassDef) TryCallSuper(methodName string, obj *Object, ctx *Context, args ...interface{}) (interface{}, error) {
+	if c.superclass == nil {
+		return nil, &MethodError{ClassName: c.Name, Method: methodName, Err: ErrNoSuchMethod, Detail: "class has no superclass"}
+	}
+	return c.superclass.TryCall(methodName, obj, ctx, args...)
+}
+
+// CallSuper is like TryCallSuper, but panics if the superclass doesn't have the method.
+func (c *ClassDef) CallSuper(methodName string, obj *Object, ctx *Context, args ...interface{}) interface{} {
+	result, err := c.TryCallSuper(methodName, obj, ctx, args...)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Superclass returns the class this one was created from via Subclass, or nil for a root class.
+func (c *ClassDef) Superclass() *ClassDef {
+	return c.superclass
+}
+
+// Ancestors returns the chain of superclasses, starting with the immediate superclass
+// and ending with the root class.
+func (c *ClassDef) Ancestors() []*ClassDef {
+	ancestors := make([]*ClassDef, 0)
+	for ancestor := c.superclass; ancestor != nil; ancestor = ancestor.superclass {
+		ancestors = append(ancestors, ancestor)
+	}
+	return ancestors
 }
 
 func NewClassDef(name string) *ClassDef {
 	return &ClassDef{Name: name, classNames: make(map[string]bool), methodDispatch: make(map[string]MethodType),
-		initialProperties: make(map[string]interface{})}
+		initialProperties: make(map[string]interface{}), propertySchemas: make(map[string]*PropertySchema), prompts: make(map[string]string)}
 }
 
 func (classDef *ClassDef) Subclass(name string) *ClassDef {
@@ -51,10 +143,31 @@ func (classDef *ClassDef) Subclass(name string) *ClassDef {
 		newMethodDispatch[k] = v
 	}
 
+	newPropertySchemas := make(map[string]*PropertySchema)
+	for k, v := range classDef.propertySchemas {
+		newPropertySchemas[k] = v
+	}
+
+	newPrompts := make(map[string]string)
+	for k, v := range classDef.prompts {
+		newPrompts[k] = v
+	}
+
 	return &ClassDef{Name: name,
+		superclass:        classDef,
 		classNames:        newClassNames,
 		methodDispatch:    newMethodDispatch,
-		initialProperties: newInitProps}
+		initialProperties: newInitProps,
+		propertySchemas:   newPropertySchemas,
+		prompts:           newPrompts}
+}
+
+// AddPrompt declares that the method takes a line of text from the player.
+// Actions which call it ask the player for the text with prompt, and pass what
+// they enter as the method's argument.
+func (c *ClassDef) AddPrompt(methodName string, prompt string) *ClassDef {
+	c.prompts[methodName] = prompt
+	return c
 }
 
 func (c *ClassDef) AddGetter(name string, initialValue interface{}) *ClassDef {
@@ -64,7 +177,12 @@ func (c *ClassDef) AddGetter(name string, initialValue interface{}) *ClassDef {
 }
 
 func (c *ClassDef) AddProperty(name string, initialValue interface{}) *ClassDef {
-	c.initialProperties[name] = initialValue
+	if schema, ok := c.propertySchemas[name]; ok {
+		if detail, err := schema.check(initialValue); err != nil {
+			panic(fmt.Sprintf("Initial value of property %s on class %s is invalid: %v (%s)", name, c.Name, err, detail))
+		}
+	}
+	c.initialProperties[name] = normalizeValue(initialValue)
 	return c
 }
 
@@ -74,7 +192,17 @@ func (c *ClassDef) AddMethod(name string, method interface{}) *ClassDef {
 
 	t := reflect.TypeOf(method)
 	v := reflect.ValueOf(method)
-	adapter := func(obj *Object, context *Context, args []interface{}) interface{} {
+	if t.Kind() != reflect.Func {
+		panic(fmt.Sprintf("Method %s must be a function, but was %v", name, t))
+	}
+	if t.NumOut() > 1 {
+		panic(fmt.Sprintf("Expect %s to return nothing or one value, but it returns %d", name, t.NumOut()))
+	}
+
+	// methods which can fail may return an error instead of a value
+	returnsError := t.NumOut() == 1 && t.Out(0) == reflect.TypeOf((*error)(nil)).Elem()
+
+	adapter := func(obj *Object, context *Context, args []interface{}) (interface{}, error) {
 		valueArgs := make([]reflect.Value, t.NumIn())
 
 		destIndex := 0
@@ -89,21 +217,26 @@ func (c *ClassDef) AddMethod(name string, method interface{}) *ClassDef {
 		}
 
 		if t.NumIn() != len(args)+destIndex {
-			panic(fmt.Sprintf("Could not call %s because it expects %d args, but called with %d args", t.Name(), t.NumIn(), len(args)+destIndex))
+			return nil, &MethodError{Err: ErrBadArity, Detail: fmt.Sprintf("expects %d args, but called with %d args", t.NumIn()-destIndex, len(args))}
 		}
 		for i, arg := range args {
-			valueArgs[i+destIndex] = reflect.ValueOf(arg)
+			value, err := coerceArg(context, arg, t.In(i+destIndex))
+			if err != nil {
+				return nil, &MethodError{Err: ErrBadArgument, Detail: fmt.Sprintf("argument %d: %v", i+1, err)}
+			}
+			valueArgs[i+destIndex] = value
 		}
 
 		result := v.Call(valueArgs)
-		if len(result) > 1 {
-			panic(fmt.Sprintf("Expect %s to return nothing or one value, but it returned %d", t.Name(), len(result)))
-		}
 		//assert len(result) == 0 || 1
+		if returnsError {
+			err, _ := result[0].Interface().(error)
+			return nil, err
+		}
 		if len(result) > 0 {
-			return result[0].Interface()
+			return result[0].Interface(), nil
 		} else {
-			return nil
+			return nil, nil
 		}
 	}
 
@@ -111,17 +244,136 @@ func (c *ClassDef) AddMethod(name string, method interface{}) *ClassDef {
 	return c
 }
 
+// coerceArg converts an argument to the type a method declares. Clients can only
+// send strings, so those are parsed into numbers and bools, or looked up as
+// object IDs when the method wants an *Object.
+func coerceArg(ctx *Context, arg interface{}, paramType reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		switch paramType.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(paramType), nil
+		}
+		return reflect.Value{}, fmt.Errorf("nil can't be used as %v", paramType)
+	}
+
+	value := reflect.ValueOf(arg)
+	if value.Type().AssignableTo(paramType) {
+		return value, nil
+	}
+
+	str, ok := arg.(string)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%T can't be used as %v", arg, paramType)
+	}
+
+	if paramType == reflect.TypeOf(&Object{}) {
+		ID, err := strconv.Atoi(str)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%q is not an object ID", str)
+		}
+		if ctx == nil || ctx.World == nil {
+			return reflect.Value{}, fmt.Errorf("no world to look up object %d in", ID)
+		}
+		obj := ctx.World.GetObject(ID)
+		if obj == nil {
+			return reflect.Value{}, fmt.Errorf("no object with ID %d", ID)
+		}
+		return reflect.ValueOf(obj), nil
+	}
+
+	converted := reflect.New(paramType).Elem()
+	switch paramType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, paramType.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%q is not a valid %v", str, paramType)
+		}
+		converted.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 10, paramType.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%q is not a valid %v", str, paramType)
+		}
+		converted.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, paramType.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%q is not a valid %v", str, paramType)
+		}
+		converted.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%q is not a valid bool", str)
+		}
+		converted.SetBool(b)
+	case reflect.String:
+		// a named string type
+		converted.SetString(str)
+	default:
+		return reflect.Value{}, fmt.Errorf("a string can't be converted to %v", paramType)
+	}
+	return converted, nil
+}
+
+// Object is a handle on an object in a particular world. Its state lives in the
+// world, so that worlds can share the state of objects they haven't modified.
 type Object struct {
-	ID         int
-	Parent     *Object
-	Children   []*Object
-	properties map[string]interface{} // map is mutable but values are immutable
-	classDef   *ClassDef
+	ID    int
+	world *World
+}
+
+var ErrNoSuchObject = errors.New("object is not in the world")
+
+// state returns the current state of the object, or nil if it's been removed from its world
+func (obj *Object) state() *objectState {
+	if obj.world == nil {
+		return nil
+	}
+	return obj.world.objects.get(obj.ID)
+}
+
+// mutableState returns the state of the object for modification, first making a
+// copy if it's shared with another world
+func (obj *Object) mutableState() *objectState {
+	w := obj.world
+	state := obj.state()
+	if state == nil {
+		panic(fmt.Sprintf("object %d is not in the world", obj.ID))
+	}
+	if w.readOnly {
+		panic(fmt.Sprintf("can't change object %d: %v", obj.ID, ErrReadOnly))
+	}
+	if state.gen != w.gen {
+		state = state.copy(w.gen)
+		w.objects.set(obj.ID, state, w.gen)
+	}
+	return state
+}
+
+func (obj *Object) Parent() *Object {
+	state := obj.state()
+	if state == nil || state.parentID == 0 {
+		return nil
+	}
+	return obj.world.handle(state.parentID)
+}
+
+func (obj *Object) Children() []*Object {
+	state := obj.state()
+	if state == nil {
+		return nil
+	}
+	children := make([]*Object, len(state.childIDs))
+	for i, childID := range state.childIDs {
+		children[i] = obj.world.handle(childID)
+	}
+	return children
 }
 
 func (obj *Object) IsInstanceOf(className string) bool {
-	_, ok := obj.classDef.classNames[className]
-	return ok
+	state := obj.state()
+	return state != nil && state.classDef.classNames[className]
 }
 
 func FilterByClass(objs []*Object, className string) []*Object {
@@ -134,35 +386,87 @@ func FilterByClass(objs []*Object, className string) []*Object {
 	return filtered
 }
 
-func (obj *Object) Call(ctx *Context, methodName string, args ...interface{}) interface{} {
-	method, ok := obj.classDef.methodDispatch[methodName]
-	if !ok {
-		methodNames := make([]string, 0)
-		for methodName := range obj.classDef.methodDispatch {
-			methodNames = append(methodNames, methodName)
+func (obj *Object) HasMethod(methodName string) bool {
+	state := obj.state()
+	if state == nil {
+		return false
+	}
+	if method, _ := objectScript(state, methodName); method != nil {
+		return true
+	}
+	_, ok := state.classDef.methodDispatch[methodName]
+	return ok
+}
+
+// TryCall invokes a method, returning an error if the method doesn't exist or
+// can't accept the given arguments. Use this for calls which originate from clients.
+func (obj *Object) TryCall(ctx *Context, methodName string, args ...interface{}) (interface{}, error) {
+	state := obj.state()
+	if state == nil {
+		return nil, &MethodError{Method: methodName, Err: ErrNoSuchObject, Detail: fmt.Sprintf("object %d", obj.ID)}
+	}
+	// scripts given to this object take precedence over its class's methods
+	method, err := objectScript(state, methodName)
+	if err != nil {
+		return nil, err
+	}
+	if method != nil {
+		result, err := method(obj, ctx, args)
+		if methodErr, ok := err.(*MethodError); ok && methodErr.Method == "" {
+			methodErr.ClassName = state.classDef.Name
+			methodErr.Method = methodName
 		}
-		log.Fatalf("Could not find method \"%s\" on class \"%s\" (Methods: %v)", methodName, obj.classDef.Name, methodNames)
+		return result, err
+	}
+	return state.classDef.TryCall(methodName, obj, ctx, args...)
+}
+
+// Call is like TryCall, but for use when the method is known to exist. Panics if it doesn't.
+func (obj *Object) Call(ctx *Context, methodName string, args ...interface{}) interface{} {
+	result, err := obj.TryCall(ctx, methodName, args...)
+	if err != nil {
+		panic(err)
 	}
-	return method(obj, ctx, args)
+	return result
 }
 
+// Set is like TrySet, but panics if the value is invalid. Returns obj so calls can be chained.
 func (obj *Object) Set(name string, value interface{}) *Object {
-	obj.properties[name] = value
+	err := obj.TrySet(name, value)
+	if err != nil {
+		panic(err)
+	}
 	return obj
 }
 
+// Get returns the value of a property. References to other objects are resolved
+// to *Objects in this object's world, or nil if the object no longer exists.
 func (obj *Object) Get(name string) interface{} {
-	return obj.properties[name]
+	state := obj.state()
+	if state == nil {
+		return nil
+	}
+	return resolveValue(obj.world, state.properties[name])
 }
 
-func (obj *Object) Append(name string, value interface{}) *Object {
-	list := obj.Get(name).([]interface{})
+func (obj *Object) TryAppend(name string, value interface{}) error {
+	list, err := obj.GetList(name)
+	if err != nil {
+		return err
+	}
 
 	newList := append([]interface{}(nil), list...)
 	newList = append(newList, value)
 
-	obj.Set(name, newList)
+	return obj.TrySet(name, newList)
+}
 
+// Append is like TryAppend, but panics if the property isn't a list. Returns obj so calls can be chained.
+func (obj *Object) Append(name string, value interface{}) *Object {
+	err := obj.TryAppend(name, value)
+	if err != nil {
+		panic(err)
+	}
 	return obj
 }
 
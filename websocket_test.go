@@ -2,8 +2,11 @@ package muddy
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -41,3 +44,146 @@ func TestWSBasics(t *testing.T) {
 
 	srv.Shutdown(context.Background())
 }
+
+func TestWSBadMethod(t *testing.T) {
+	addr := "127.0.0.1:2701"
+
+	builder := func() *WorldBasics {
+		return NewWorldBasics(NewWorld())
+	}
+
+	srv := createServer(builder)
+	ln := createListener(addr)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/game/gameid/sessionid/ws", nil)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// the initial view
+	_, _, err = c.ReadMessage()
+	assert.Nil(t, err)
+
+	err = c.WriteMessage(websocket.TextMessage, []byte(`{"objectID": 1, "method": "nope"}`))
+	assert.Nil(t, err)
+
+	// the server survives and tells us what went wrong
+	_, buf, err := c.ReadMessage()
+	assert.Nil(t, err)
+	var message ErrorMessage
+	assert.Nil(t, json.Unmarshal(buf, &message))
+	assert.Contains(t, message.Error, "not one of the player's actions")
+}
+
+func TestWSMultipleTabs(t *testing.T) {
+	addr := "127.0.0.1:2702"
+
+	builder := func() *WorldBasics {
+		return NewWorldBasics(NewWorld())
+	}
+
+	srv := createServer(builder)
+	ln := createListener(addr)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	readView := func(c *websocket.Conn) *View {
+		_, buf, err := c.ReadMessage()
+		assert.Nil(t, err)
+		var view View
+		assert.Nil(t, json.Unmarshal(buf, &view))
+		return &view
+	}
+
+	url := "ws://" + addr + "/game/gameid/sessionid/ws"
+	tab1, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, readView(tab1).Lobby)
+
+	// a second tab gets the current view of the same player straight away
+	tab2, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, readView(tab2).Lobby)
+
+	// naming the player in one tab updates both
+	err = tab1.WriteMessage(websocket.TextMessage, []byte(`{"name": "duck"}`))
+	assert.Nil(t, err)
+	for _, c := range []*websocket.Conn{tab1, tab2} {
+		_, buf, err := c.ReadMessage()
+		assert.Nil(t, err)
+		assert.Contains(t, string(buf), "/Lobby")
+	}
+
+	tab1.Close()
+	tab2.Close()
+
+	// reconnecting binds to the same, already named, player
+	tab3, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	defer tab3.Close()
+	assert.Nil(t, readView(tab3).Lobby)
+}
+
+func TestForwardEvents(t *testing.T) {
+	out := make(chan interface{})
+	in := forwardEvents(out)
+
+	// sends don't wait for out, and whatever is queued is still delivered after in is closed
+	for i := 0; i < 3; i++ {
+		in <- i
+	}
+	close(in)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i, <-out)
+	}
+}
+
+func TestSendSnapshot(t *testing.T) {
+	client := &Client{snapshotChan: make(chan *PlayerSnapshot, 1)}
+
+	// a client which is busy only gets the latest snapshot, and a resync isn't lost
+	first, second := NewWorld(), NewWorld()
+	client.sendSnapshot(&PlayerSnapshot{snapshot: first, resync: true})
+	client.sendSnapshot(&PlayerSnapshot{snapshot: second})
+	latest := <-client.snapshotChan
+	assert.Equal(t, second, latest.snapshot)
+	assert.True(t, latest.resync)
+	assert.Equal(t, 0, len(client.snapshotChan))
+}
+
+func TestWSBuilderToken(t *testing.T) {
+	addr := "127.0.0.1:2703"
+
+	builder := func() *WorldBasics {
+		world := NewWorldBasics(NewWorld())
+		world.BuilderToken = "secret"
+		return world
+	}
+
+	srv := createServer(builder)
+	ln := createListener(addr)
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/game/gameid/sessionid/ws", nil)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	err = c.WriteMessage(websocket.TextMessage, []byte(`{"name": "duck"}`))
+	assert.Nil(t, err)
+	err = c.WriteMessage(websocket.TextMessage, []byte(`{"builder": "secret"}`))
+	assert.Nil(t, err)
+	// the build section turns up in a later update. Updates which come close
+	// together may be merged, so there's no telling which one.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	found := false
+	for !found {
+		_, buf, err := c.ReadMessage()
+		if !assert.Nil(t, err) {
+			break
+		}
+		found = strings.Contains(string(buf), `"build"`)
+	}
+	assert.True(t, found)
+}
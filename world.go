@@ -1,34 +1,125 @@
 package muddy
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 type Session struct {
 	playerID int
 }
 
 type World struct {
-	objects     map[int]*Object
+	objects objectTable
+	// objects and table nodes which belong to this generation can be modified in
+	// place. Anything else is shared with another world and must be copied first.
+	gen         uint64
 	nextID      int
 	ObjectClass *ClassDef
+	// classes which objects can be bound to when loading a snapshot
+	classes map[string]*ClassDef
+	// the *Object for each ID, so that each object has a single handle per world.
+	// A sync.Map because snapshots are read by many goroutines at once.
+	handles sync.Map
+	// where the time comes from for timers and countdowns
+	Clock Clock
+	// runs timers for methods, such as closing a door after a while. Clones have
+	// none, since timers stay with the world which is running them.
+	Scheduler *Scheduler
+	// countdowns which players can see, maintained by the world's Scheduler
+	countdowns []*countdown
+	// what the universe calls this world, which conference names are derived from
+	ID string
+	// names the video conference for each room
+	Conferences ConferenceNamer
+	// set on snapshots, which are shared by the goroutines rendering views from them
+	readOnly bool
 }
 
+// ErrReadOnly is returned when something tries to change a snapshot
+var ErrReadOnly = errors.New("world is a read-only snapshot")
+
 func NewWorld() *World {
-	return &World{objects: make(map[int]*Object), nextID: 1, ObjectClass: NewClassDef("Object")}
+	world := &World{gen: nextGeneration(), nextID: 1, ObjectClass: NewClassDef("Object"), classes: make(map[string]*ClassDef), Clock: RealClock, Conferences: DefaultConferenceNamer}
+	world.RegisterClass(world.ObjectClass)
+	world.Scheduler = NewScheduler(world)
+	return world
+}
+
+// handle returns the *Object used to refer to the given ID in this world
+func (w *World) handle(ID int) *Object {
+	if obj, ok := w.handles.Load(ID); ok {
+		return obj.(*Object)
+	}
+	obj, _ := w.handles.LoadOrStore(ID, &Object{ID: ID, world: w})
+	return obj.(*Object)
 }
 
 func (w *World) AddObject(parent *Object, classDef *ClassDef) *Object {
 	ID := w.nextID
 	w.nextID += 1
-	object := &Object{ID: ID, Parent: parent, properties: make(map[string]interface{}), classDef: classDef}
+	state := &objectState{gen: w.gen, classDef: classDef, properties: make(map[string]interface{})}
 	for prop, value := range classDef.initialProperties {
-		object.properties[prop] = value
+		state.properties[prop] = value
 	}
-	w.objects[ID] = object
 	if parent != nil {
-		parent.Children = append(parent.Children, object)
+		state.parentID = parent.ID
+		parentState := parent.mutableState()
+		parentState.childIDs = append(parentState.childIDs, ID)
+	}
+	w.objects.set(ID, state, w.gen)
+	return w.handle(ID)
+}
+
+// GetObject returns the object with the given ID, or nil if there isn't one
+func (w *World) GetObject(ID int) *Object {
+	if w.objects.get(ID) == nil {
+		return nil
 	}
-	return object
+	return w.handle(ID)
 }
 
-func removeObject(list []*Object, toRemove *Object) ([]*Object, bool) {
+// FindAll returns every object which is an instance of className, in order of ID
+func (w *World) FindAll(className string) []*Object {
+	found := make([]*Object, 0)
+	w.objects.each(func(ID int, state *objectState) {
+		if state.classDef.classNames[className] {
+			found = append(found, w.handle(ID))
+		}
+	})
+	return found
+}
+
+// Contains returns true if obj is an object in this world
+func (w *World) Contains(obj *Object) bool {
+	return obj != nil && obj.world == w && w.objects.get(obj.ID) != nil
+}
+
+func containsObject(list []*Object, obj *Object) bool {
+	for _, element := range list {
+		if element == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVisibleTo returns true if obj is somewhere within the player's room (or the
+// player themselves). Objects in closed containers count as visible.
+func IsVisibleTo(player *Object, obj *Object) bool {
+	room := player.Parent()
+	for ; obj != nil; obj = obj.Parent() {
+		if obj == player || (room != nil && obj == room) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(list []int, toRemove int) ([]int, bool) {
 	for index, element := range list {
 		if element == toRemove {
 			return append(list[:index], list[index+1:]...), true
@@ -37,66 +128,370 @@ func removeObject(list []*Object, toRemove *Object) ([]*Object, bool) {
 	return list, false
 }
 
-func (w *World) Move(a *Object, b *Object) {
-	// move A to be a child of B
-	if a.Parent != nil {
+// detach removes an object from its parent's list of children
+func (w *World) detach(a *Object) {
+	state := a.mutableState()
+	if state.parentID != 0 {
+		parentState := w.handle(state.parentID).mutableState()
 		var removed bool
-		a.Parent.Children, removed = removeObject(a.Parent.Children, a)
+		parentState.childIDs, removed = removeID(parentState.childIDs, a.ID)
 		if !removed {
 			panic("element wasn't in child array")
 		}
+		state.parentID = 0
 	}
-	a.Parent = b
-	b.Children = append(b.Children, a)
 }
 
-func (w *World) Clone() *World {
-	newObjects := make(map[int]*Object)
-	for id, obj := range w.objects {
-		newProperties := make(map[string]interface{})
-		for prop, value := range obj.properties {
-			newProperties[prop] = value
+func (w *World) Move(a *Object, b *Object) {
+	// move A to be a child of B
+	w.detach(a)
+	a.mutableState().parentID = b.ID
+	bState := b.mutableState()
+	bState.childIDs = append(bState.childIDs, a.ID)
+}
+
+// RemoveMode controls what happens to the children of a removed object and to
+// references to it. The zero value removes the whole subtree and clears references.
+type RemoveMode struct {
+	// if set, the children of the removed object are moved here instead of being removed too
+	MoveChildrenTo *Object
+	// if set, references to removed objects are left in place (Get returns nil for
+	// them) instead of being cleared
+	KeepReferences bool
+}
+
+var RemoveSubtree = RemoveMode{}
+
+func MoveChildrenTo(fallback *Object) RemoveMode {
+	return RemoveMode{MoveChildrenTo: fallback}
+}
+
+func (w *World) isInSubtree(obj *Object, root *Object) bool {
+	for ; obj != nil; obj = obj.Parent() {
+		if obj == root {
+			return true
 		}
-		// copy fields which don't reference *Objects. We'll do the rest in a second pass
-		newObjects[id] = &Object{ID: id, properties: newProperties, classDef: obj.classDef}
 	}
+	return false
+}
 
-	for id, obj := range w.objects {
-		// now fill in all the object pointers
-		newObj := newObjects[id]
-		if obj.Parent != nil {
-			newObj.Parent = newObjects[obj.Parent.ID]
+// RemoveObject deletes an object (and, depending on mode, its descendants) from
+// the world. Returns the references other objects held to the removed objects,
+// which have been cleared unless mode.KeepReferences is set.
+func (w *World) RemoveObject(obj *Object, mode RemoveMode) ([]*DanglingReference, error) {
+	if !w.Contains(obj) {
+		return nil, fmt.Errorf("object %d is not in this world", obj.ID)
+	}
+	fallback := mode.MoveChildrenTo
+	if fallback != nil {
+		if !w.Contains(fallback) {
+			return nil, fmt.Errorf("can't move children to object %d because it's not in this world", fallback.ID)
+		}
+		if w.isInSubtree(fallback, obj) {
+			return nil, fmt.Errorf("can't move children of %d to %d, because it is being removed", obj.ID, fallback.ID)
 		}
+		for _, child := range obj.Children() {
+			w.Move(child, fallback)
+		}
+	}
 
-		newObj.Children = make([]*Object, len(obj.Children))
-		for i, child := range obj.Children {
-			newObj.Children[i] = newObjects[child.ID]
+	w.detach(obj)
+
+	removedIDs := make(map[int]bool)
+	var remove func(ID int)
+	remove = func(ID int) {
+		for _, childID := range w.objects.get(ID).childIDs {
+			remove(childID)
 		}
+		removedIDs[ID] = true
+		w.objects.set(ID, nil, w.gen)
+		w.handles.Delete(ID)
 	}
+	remove(obj.ID)
+
+	wasRemoved := func(ID int) bool { return removedIDs[ID] }
+	if mode.KeepReferences {
+		return w.findRefsTo(wasRemoved), nil
+	}
+	return w.clearRefsTo(wasRemoved), nil
+}
+
+// Clone returns an independent copy of the world. This is cheap: the copy shares
+// all its state with the original, and each world copies an object the first
+// time it modifies it. Properties which refer to other objects hold ObjectRefs,
+// which are resolved against the owning object's world, so they don't need to
+// be remapped.
+func (w *World) Clone() *World {
+	// neither world may modify the state they now share
+	w.gen = nextGeneration()
+	return &World{objects: w.objects, gen: nextGeneration(), nextID: w.nextID, ObjectClass: w.ObjectClass, classes: w.classes, Clock: w.Clock, countdowns: w.countdowns, ID: w.ID, Conferences: w.Conferences}
+}
 
-	return &World{objects: newObjects}
+// Snapshot is like Clone, but the copy can't be changed. Each snapshot of a
+// running world is shared by every client rendering its view, so methods called
+// while rendering (including scripts) must only read from it.
+func (w *World) Snapshot() *World {
+	snapshot := w.Clone()
+	snapshot.readOnly = true
+	return snapshot
 }
 
 // format of markup
 // text is normal by default
 // [Name] signifies it's an object by name (maybe obj ID ?)
 // [Name text]
+//
+// Names are resolved against the objects in scope (typically the contents of the
+// room being described). References which can't be resolved are rendered as plain text.
+
+func markupToBlocks(ctx *Context, scope []*Object, text string) []*Block {
+	blocks := make([]*Block, 0)
+	for len(text) > 0 {
+		start := strings.Index(text, "[")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], "]")
+		if end < 0 {
+			break
+		}
+		end += start
+
+		if start > 0 {
+			blocks = append(blocks, NewTextBlock(text[:start]))
+		}
 
-func markupToBlocks(text string) []*Block {
-	return []*Block{NewTextBlock(text)}
+		name := text[start+1 : end]
+		label := name
+		if space := strings.Index(name, " "); space >= 0 {
+			label = name[space+1:]
+			name = name[:space]
+		}
+
+		obj := findByName(scope, name)
+		if obj == nil {
+			blocks = append(blocks, NewTextBlock(label))
+		} else {
+			blocks = append(blocks, NewObjectBlock(ctx, obj, label))
+		}
+
+		text = text[end+1:]
+	}
+	if len(text) > 0 {
+		blocks = append(blocks, NewTextBlock(text))
+	}
+	return blocks
+}
+
+func findByName(objs []*Object, name string) *Object {
+	for _, obj := range objs {
+		if obj.Get("name") == name {
+			return obj
+		}
+	}
+	return nil
 }
 
 func NewTextBlock(text string) *Block {
 	return &Block{Type: "text", Text: text}
 }
 
+// newAction converts an entry from a list of obj's actions, which is either the
+// name of a method or an *Action. A method name becomes a prompt if the object's
+// class declared one for it with AddPrompt, otherwise a call with no arguments.
+// Returns nil for anything else.
+func newAction(obj *Object, entry interface{}, objectID string) *Action {
+	switch e := entry.(type) {
+	case string:
+		if prompt, ok := obj.state().classDef.prompts[e]; ok {
+			return &Action{Type: "prompt", Label: e, Prompt: prompt, objectID: objectID}
+		}
+		return &Action{Type: "call", Label: e, objectID: objectID}
+	case *Action:
+		action := *e
+		if action.Type == "" {
+			action.Type = "call"
+		}
+		action.objectID = objectID
+		return &action
+	}
+	return nil
+}
+
+func NewObjectBlock(ctx *Context, obj *Object, text string) *Block {
+	ID := strconv.Itoa(obj.ID)
+	actions := make([]*Action, 0)
+	if obj.HasMethod("getActions") {
+		for _, entry := range resultList(obj.Call(ctx, "getActions")) {
+			if action := newAction(obj, entry, ID); action != nil {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return &Block{Type: "object", Text: text, ID: &ID, Actions: actions}
+}
+
 func (w *World) GetView(playerID int) *View {
-	player := w.objects[playerID]
+	player := w.GetObject(playerID)
+	if player == nil {
+		// their player has been removed from the world, so there's nothing left to show them
+		return &View{Lobby: &LobbyView{Prompt: "You are no longer in this world"}}
+	}
+	if player.Get("name") == "" {
+		// until they pick a name, they're waiting to join
+		return &View{Lobby: &LobbyView{Prompt: "Enter name"}}
+	}
+
+	room := player.Parent()
+	ctx := &Context{Player: player, World: w}
+
+	description, _ := room.Call(ctx, "getDescription").(string)
+
+	view := &View{Content: markupToBlocks(ctx, room.Children(), description), Sections: make([]*Section, 0), TimeRemaining: w.timeRemaining(player)}
+	// moving to another room switches them to its conference
+	view.JitsiMode, view.JitsiRoom = w.conference(room)
+	for _, section := range roomSections {
+		if room.HasMethod(section.method) {
+			objs := resultObjects(room.Call(ctx, section.method))
+			view.Sections = append(view.Sections, &Section{Name: section.name, Title: section.title, Content: objectBlocks(ctx, objs)})
+		}
+	}
+	if player.HasMethod("getInventory") {
+		objs := resultObjects(player.Call(ctx, "getInventory"))
+		view.Sections = append(view.Sections, &Section{Name: "inventory", Title: "Inventory", Content: objectBlocks(ctx, objs)})
+	}
+	if builder, _ := player.GetBool("builder"); builder {
+		view.Sections = append(view.Sections, buildSection(ctx, room))
+	}
+	if player.HasMethod("getMessages") {
+		content := make([]*Block, 0)
+		for _, message := range resultStrings(player.Call(ctx, "getMessages")) {
+			content = append(content, NewTextBlock(message))
+		}
+		view.Sections = append(view.Sections, &Section{Name: "messages", Title: "Messages", Content: content})
+	}
+	if player.HasMethod("getModal") {
+		if modal, ok := player.Call(ctx, "getModal").(*Object); ok {
+			view.Modal = modalView(ctx, modal)
+		}
+	}
+	if player.HasMethod("getFocus") {
+		if focus, ok := player.Call(ctx, "getFocus").(*Object); ok && IsVisibleTo(player, focus) {
+			view.Sections = append(view.Sections, focusSection(ctx, focus))
+		}
+	}
+	return view
+}
 
-	room := player.Parent
-	ctx := &Context{Player: player}
+// the sections of a room's view, and the method on the room which lists what goes in each
+var roomSections = []struct {
+	name   string
+	title  string
+	method string
+}{
+	{"exits", "Exits", "getExits"},
+	{"contents", "Items", "getContents"},
+	{"players", "Players", "getPlayers"},
+}
+
+// modalView shows a modal which has been opened for a player. Its ID is what the
+// client sends back to close it or submit a form.
+func modalView(ctx *Context, modal *Object) *ModalView {
+	kind, _ := modal.GetString("kind")
+	content, _ := modal.GetString("content")
+	showDone, _ := modal.GetBool("showDone")
+	view := &ModalView{Type: kind, ID: strconv.Itoa(modal.ID), ShowDone: showDone}
+	switch kind {
+	case "form":
+		if form, _ := modal.GetRef("opener"); form != nil {
+			guesses, _ := modal.GetList("guesses")
+			view.Form = formView(ctx, form, listStrings(guesses))
+		}
+	case "url":
+		view.URL = &content
+	case "html":
+		view.HTML = &content
+	}
+	return view
+}
+
+// formView shows the questions of a puzzle, filled in with the player's guesses so far
+func formView(ctx *Context, form *Object, guesses []string) *FormView {
+	correct := resultBools(form.Call(ctx, "checkAnswers", guesses))
+	rows := make([]*FormRow, 0)
+	for i, question := range resultStrings(form.Call(ctx, "getQuestions")) {
+		row := &FormRow{Caption: question}
+		if i < len(guesses) {
+			row.Guess = guesses[i]
+			// blank rows haven't been attempted yet, rather than being wrong
+			row.Correct = guesses[i] != "" && i < len(correct) && correct[i]
+		}
+		rows = append(rows, row)
+	}
+	title, _ := form.GetString("title")
+	return &FormView{Title: title, Rows: rows}
+}
+
+// buildSection lists the room and everything in it, with the actions builders can use on each
+func buildSection(ctx *Context, room *Object) *Section {
+	content := make([]*Block, 0)
+	for _, obj := range append([]*Object{room}, room.Children()...) {
+		if !obj.HasMethod("getBuildActions") {
+			continue
+		}
+		ID := strconv.Itoa(obj.ID)
+		actions := make([]*Action, 0)
+		for _, entry := range resultList(obj.Call(ctx, "getBuildActions")) {
+			if action := newAction(obj, entry, ID); action != nil {
+				actions = append(actions, action)
+			}
+		}
+		content = append(content, &Block{Type: "object", Text: objectLabel(ctx, obj), ID: &ID, Actions: actions})
+	}
+	return &Section{Name: "build", Title: "Build", Content: content}
+}
 
-	description := room.Call(ctx, "getDescription").(string)
+// focusSection is the detail panel for the thing a player is focused on
+func focusSection(ctx *Context, thing *Object) *Section {
+	label := objectLabel(ctx, thing)
+	header := NewObjectBlock(ctx, thing, label)
+	header.Actions = append(header.Actions, &Action{Type: "call", Label: "StopInspecting", objectID: *header.ID})
+	content := []*Block{header}
 
-	return &View{Content: markupToBlocks(description)}
+	if thing.HasMethod("getDescription") {
+		if description, ok := thing.Call(ctx, "getDescription").(string); ok && description != "" {
+			content = append(content, markupToBlocks(ctx, thing.Children(), description)...)
+		}
+	}
+
+	if thing.HasMethod("getWatching") {
+		others := make([]string, 0)
+		for _, watcher := range resultObjects(thing.Call(ctx, "getWatching")) {
+			if watcher != ctx.Player {
+				others = append(others, objectLabel(ctx, watcher))
+			}
+		}
+		if len(others) > 0 {
+			content = append(content, NewTextBlock("Also looking: "+strings.Join(others, ", ")))
+		}
+	}
+
+	return &Section{Name: "focus", Title: label, Content: content}
+}
+
+func objectLabel(ctx *Context, obj *Object) string {
+	if obj.HasMethod("getName") {
+		if name, ok := obj.Call(ctx, "getName").(string); ok {
+			return name
+		}
+	}
+	return "#" + strconv.Itoa(obj.ID)
+}
+
+func objectBlocks(ctx *Context, objs []*Object) []*Block {
+	blocks := make([]*Block, len(objs))
+	for i, obj := range objs {
+		blocks[i] = NewObjectBlock(ctx, obj, objectLabel(ctx, obj))
+	}
+	return blocks
 }
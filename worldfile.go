@@ -0,0 +1,605 @@
+package muddy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// World definition files describe a world in YAML instead of Go. For example:
+//
+//	rooms:
+//	  - name: lobby
+//	    description: A grand lobby. A [door] leads to the beach.
+//	    exits:
+//	      - to: Beach
+//	        name: door
+//	  - name: Beach
+//	    description: Sand as far as the eye can see. There's a [shell] here.
+//	    items:
+//	      - name: shell
+//	        properties:
+//	          weight: 2
+//	    exits:
+//	      - to: lobby
+//	        locked: true
+//	        key: shell
+//
+// Rooms named "lobby" and "nowhere" refer to WorldBasics.Lobby and
+// WorldBasics.Nowhere instead of creating new rooms. Rooms, items and exits may
+// name a registered class to use instead of the default one. The key of a locked
+// exit names an item, which must only appear once in the file.
+
+type WorldDefinition struct {
+	Filename string            `yaml:"-"`
+	Rooms    []*RoomDefinition `yaml:"rooms"`
+}
+
+type RoomDefinition struct {
+	Name        string                 `yaml:"name"`
+	Class       string                 `yaml:"class,omitempty"`
+	Description string                 `yaml:"description,omitempty"`
+	Properties  map[string]interface{} `yaml:"properties,omitempty"`
+	Items       []*ItemDefinition      `yaml:"items,omitempty"`
+	Exits       []*ExitDefinition      `yaml:"exits,omitempty"`
+	pos         *yaml.Node
+}
+
+type ItemDefinition struct {
+	Name        string                 `yaml:"name"`
+	Class       string                 `yaml:"class,omitempty"`
+	Description string                 `yaml:"description,omitempty"`
+	Properties  map[string]interface{} `yaml:"properties,omitempty"`
+	pos         *yaml.Node
+}
+
+type ExitDefinition struct {
+	To         string                 `yaml:"to"`
+	Name       string                 `yaml:"name,omitempty"`
+	Class      string                 `yaml:"class,omitempty"`
+	Locked     bool                   `yaml:"locked,omitempty"`
+	Key        string                 `yaml:"key,omitempty"`
+	Properties map[string]interface{} `yaml:"properties,omitempty"`
+	pos        *yaml.Node
+}
+
+// DefinitionError is a problem with a world definition, along with where in the
+// file it was found.
+type DefinitionError struct {
+	Filename string
+	Line     int
+	Column   int
+	Message  string
+}
+
+func (e *DefinitionError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column, e.Message)
+}
+
+type definitionParser struct {
+	filename string
+}
+
+func (p *definitionParser) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return &DefinitionError{Filename: p.filename, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// mapping returns the values of a mapping node by key, rejecting any keys which aren't allowed
+func (p *definitionParser) mapping(node *yaml.Node, allowed ...string) (map[string]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, p.errorf(node, "expected a mapping")
+	}
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !containsString(allowed, key.Value) {
+			return nil, p.errorf(key, "unknown field \"%s\" (expected one of: %s)", key.Value, strings.Join(allowed, ", "))
+		}
+		if _, exists := fields[key.Value]; exists {
+			return nil, p.errorf(key, "field \"%s\" appears more than once", key.Value)
+		}
+		fields[key.Value] = value
+	}
+	return fields, nil
+}
+
+func (p *definitionParser) sequence(node *yaml.Node) ([]*yaml.Node, error) {
+	if node == nil {
+		return nil, nil
+	}
+	if node.Kind != yaml.SequenceNode {
+		return nil, p.errorf(node, "expected a list")
+	}
+	return node.Content, nil
+}
+
+func (p *definitionParser) str(node *yaml.Node) (string, error) {
+	if node == nil {
+		return "", nil
+	}
+	if node.Kind != yaml.ScalarNode {
+		return "", p.errorf(node, "expected a string")
+	}
+	return node.Value, nil
+}
+
+func (p *definitionParser) requiredStr(fields map[string]*yaml.Node, parent *yaml.Node, name string) (string, error) {
+	value, err := p.str(fields[name])
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", p.errorf(parent, "missing required field \"%s\"", name)
+	}
+	return value, nil
+}
+
+func (p *definitionParser) boolean(node *yaml.Node) (bool, error) {
+	var value bool
+	if node == nil {
+		return false, nil
+	}
+	if node.Kind != yaml.ScalarNode || node.Decode(&value) != nil {
+		return false, p.errorf(node, "expected true or false")
+	}
+	return value, nil
+}
+
+// value converts a node into one of the property value types that a world can hold
+func (p *definitionParser) value(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, p.errorf(node, "%v", err)
+		}
+		switch value.(type) {
+		case nil, string, int, bool, float64:
+			return value, nil
+		}
+		return nil, p.errorf(node, "unsupported property value %q", node.Value)
+	case yaml.SequenceNode:
+		list := make([]interface{}, len(node.Content))
+		for i, element := range node.Content {
+			value, err := p.value(element)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+	return nil, p.errorf(node, "property values must be a string, number, boolean or list")
+}
+
+func (p *definitionParser) properties(node *yaml.Node) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	if node == nil {
+		return properties, nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, p.errorf(node, "expected a mapping of property names to values")
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, valueNode := node.Content[i], node.Content[i+1]
+		if _, exists := properties[key.Value]; exists {
+			return nil, p.errorf(key, "property \"%s\" appears more than once", key.Value)
+		}
+		value, err := p.value(valueNode)
+		if err != nil {
+			return nil, err
+		}
+		properties[key.Value] = value
+	}
+	return properties, nil
+}
+
+func (p *definitionParser) item(node *yaml.Node) (*ItemDefinition, error) {
+	fields, err := p.mapping(node, "name", "class", "description", "properties")
+	if err != nil {
+		return nil, err
+	}
+	item := &ItemDefinition{pos: node}
+	if item.Name, err = p.requiredStr(fields, node, "name"); err != nil {
+		return nil, err
+	}
+	if item.Class, err = p.str(fields["class"]); err != nil {
+		return nil, err
+	}
+	if item.Description, err = p.str(fields["description"]); err != nil {
+		return nil, err
+	}
+	if item.Properties, err = p.properties(fields["properties"]); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (p *definitionParser) exit(node *yaml.Node) (*ExitDefinition, error) {
+	fields, err := p.mapping(node, "to", "name", "class", "locked", "key", "properties")
+	if err != nil {
+		return nil, err
+	}
+	exit := &ExitDefinition{pos: node}
+	if exit.To, err = p.requiredStr(fields, node, "to"); err != nil {
+		return nil, err
+	}
+	if exit.Name, err = p.str(fields["name"]); err != nil {
+		return nil, err
+	}
+	if exit.Class, err = p.str(fields["class"]); err != nil {
+		return nil, err
+	}
+	if exit.Locked, err = p.boolean(fields["locked"]); err != nil {
+		return nil, err
+	}
+	if exit.Key, err = p.str(fields["key"]); err != nil {
+		return nil, err
+	}
+	if exit.Key != "" && !exit.Locked {
+		return nil, p.errorf(fields["key"], "only locked exits can have a key")
+	}
+	if exit.Properties, err = p.properties(fields["properties"]); err != nil {
+		return nil, err
+	}
+	return exit, nil
+}
+
+func (p *definitionParser) room(node *yaml.Node) (*RoomDefinition, error) {
+	fields, err := p.mapping(node, "name", "class", "description", "properties", "items", "exits")
+	if err != nil {
+		return nil, err
+	}
+	room := &RoomDefinition{pos: node}
+	if room.Name, err = p.requiredStr(fields, node, "name"); err != nil {
+		return nil, err
+	}
+	if room.Class, err = p.str(fields["class"]); err != nil {
+		return nil, err
+	}
+	if room.Description, err = p.str(fields["description"]); err != nil {
+		return nil, err
+	}
+	if room.Properties, err = p.properties(fields["properties"]); err != nil {
+		return nil, err
+	}
+
+	itemNodes, err := p.sequence(fields["items"])
+	if err != nil {
+		return nil, err
+	}
+	itemsByName := make(map[string]*ItemDefinition)
+	for _, itemNode := range itemNodes {
+		item, err := p.item(itemNode)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := itemsByName[item.Name]; ok {
+			return nil, p.errorf(itemNode, "duplicate item \"%s\" in room \"%s\" (first defined at line %d)", item.Name, room.Name, existing.pos.Line)
+		}
+		itemsByName[item.Name] = item
+		room.Items = append(room.Items, item)
+	}
+
+	exitNodes, err := p.sequence(fields["exits"])
+	if err != nil {
+		return nil, err
+	}
+	for _, exitNode := range exitNodes {
+		exit, err := p.exit(exitNode)
+		if err != nil {
+			return nil, err
+		}
+		room.Exits = append(room.Exits, exit)
+	}
+
+	return room, nil
+}
+
+// ParseWorldDefinition parses and checks the structure of a world definition.
+// filename is only used for reporting errors.
+func ParseWorldDefinition(filename string, data []byte) (*WorldDefinition, error) {
+	p := &definitionParser{filename: filename}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	def := &WorldDefinition{Filename: filename}
+	if len(document.Content) == 0 {
+		return def, nil
+	}
+
+	root := document.Content[0]
+	fields, err := p.mapping(root, "rooms")
+	if err != nil {
+		return nil, err
+	}
+	roomNodes, err := p.sequence(fields["rooms"])
+	if err != nil {
+		return nil, err
+	}
+
+	roomsByName := make(map[string]*RoomDefinition)
+	for _, roomNode := range roomNodes {
+		room, err := p.room(roomNode)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := roomsByName[room.Name]; ok {
+			return nil, p.errorf(roomNode, "duplicate room \"%s\" (first defined at line %d)", room.Name, existing.pos.Line)
+		}
+		roomsByName[room.Name] = room
+		def.Rooms = append(def.Rooms, room)
+	}
+
+	itemCounts := make(map[string]int)
+	for _, room := range def.Rooms {
+		for _, item := range room.Items {
+			itemCounts[item.Name]++
+		}
+	}
+
+	for _, room := range def.Rooms {
+		for _, exit := range room.Exits {
+			if _, ok := roomsByName[exit.To]; !ok && !isBuiltinRoom(exit.To) {
+				return nil, p.errorf(exit.pos, "exit from \"%s\" leads to unknown room \"%s\"", room.Name, exit.To)
+			}
+			if exit.Key != "" && itemCounts[exit.Key] != 1 {
+				if itemCounts[exit.Key] == 0 {
+					return nil, p.errorf(exit.pos, "key \"%s\" is not an item", exit.Key)
+				}
+				return nil, p.errorf(exit.pos, "key \"%s\" is ambiguous because there are %d items with that name", exit.Key, itemCounts[exit.Key])
+			}
+		}
+	}
+
+	return def, nil
+}
+
+func isBuiltinRoom(name string) bool {
+	return name == "lobby" || name == "nowhere"
+}
+
+func containsString(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupClass finds the class to use for an object. An empty name means the
+// default class. Otherwise it must be registered with the world and be a
+// subclass of requiredClassName.
+func (def *WorldDefinition) lookupClass(w *WorldBasics, pos *yaml.Node, name string, defaultClass *ClassDef, requiredClassName string) (*ClassDef, error) {
+	if name == "" {
+		return defaultClass, nil
+	}
+	p := &definitionParser{filename: def.Filename}
+	classDef, ok := w.World.classes[name]
+	if !ok {
+		return nil, p.errorf(pos, "unknown class \"%s\"", name)
+	}
+	if !classDef.classNames[requiredClassName] {
+		return nil, p.errorf(pos, "class \"%s\" is not a subclass of %s", name, requiredClassName)
+	}
+	return classDef, nil
+}
+
+func (def *WorldDefinition) setProperties(obj *Object, pos *yaml.Node, properties map[string]interface{}) error {
+	for name, value := range properties {
+		if err := obj.TrySet(name, value); err != nil {
+			return (&definitionParser{filename: def.Filename}).errorf(pos, "%v", err)
+		}
+	}
+	return nil
+}
+
+// Build adds everything in the definition to the world.
+func (def *WorldDefinition) Build(w *WorldBasics) error {
+	rooms := map[string]*Object{"lobby": w.Lobby, "nowhere": w.Nowhere}
+	items := make(map[string]*Object)
+
+	for _, roomDef := range def.Rooms {
+		room, isBuiltin := rooms[roomDef.Name]
+		if !isBuiltin {
+			classDef, err := def.lookupClass(w, roomDef.pos, roomDef.Class, w.Room, RoomClassName)
+			if err != nil {
+				return err
+			}
+			room = w.World.AddObject(nil, classDef).Set("name", roomDef.Name)
+			rooms[roomDef.Name] = room
+		} else if roomDef.Class != "" {
+			return (&definitionParser{filename: def.Filename}).errorf(roomDef.pos, "the class of \"%s\" can't be changed", roomDef.Name)
+		}
+		if roomDef.Description != "" {
+			room.Set("description", roomDef.Description)
+		}
+		if err := def.setProperties(room, roomDef.pos, roomDef.Properties); err != nil {
+			return err
+		}
+
+		for _, itemDef := range roomDef.Items {
+			classDef, err := def.lookupClass(w, itemDef.pos, itemDef.Class, w.Item, ThingClassName)
+			if err != nil {
+				return err
+			}
+			item := w.World.AddObject(room, classDef).Set("name", itemDef.Name)
+			items[itemDef.Name] = item
+			if itemDef.Description != "" {
+				item.Set("description", itemDef.Description)
+			}
+			if err := def.setProperties(item, itemDef.pos, itemDef.Properties); err != nil {
+				return err
+			}
+		}
+	}
+
+	// add exits once all the rooms they might lead to exist
+	for _, roomDef := range def.Rooms {
+		room := rooms[roomDef.Name]
+		for _, exitDef := range roomDef.Exits {
+			defaultClass := w.Exit
+			requiredClassName := ExitClassName
+			if exitDef.Locked {
+				defaultClass = w.LockedExit
+				requiredClassName = LockedExitClassName
+			}
+			classDef, err := def.lookupClass(w, exitDef.pos, exitDef.Class, defaultClass, requiredClassName)
+			if err != nil {
+				return err
+			}
+			exit := w.World.AddObject(room, classDef).Set("destination", rooms[exitDef.To])
+			if exitDef.Name != "" {
+				exit.Set("name", exitDef.Name)
+			}
+			if exitDef.Locked {
+				exit.Set("locked", true)
+			}
+			if exitDef.Key != "" {
+				if err := def.setProperties(exit, exitDef.pos, map[string]interface{}{"key": items[exitDef.Key]}); err != nil {
+					return err
+				}
+			}
+			if err := def.setProperties(exit, exitDef.pos, exitDef.Properties); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Marshal writes the definition in the same format ParseWorldDefinition reads
+func (def *WorldDefinition) Marshal() ([]byte, error) {
+	return yaml.Marshal(def)
+}
+
+// ExportDefinition describes the world as it is now, so that changes made by
+// builders can be saved and loaded again with LoadWorldFile. Only what a world
+// definition can express is included, so players, things inside other things and
+// properties which refer to objects are left out.
+func (w *WorldBasics) ExportDefinition() (*WorldDefinition, error) {
+	def := &WorldDefinition{}
+
+	// everything in a definition refers to rooms by name, so they must be unique
+	roomNames := make(map[int]string)
+	seen := make(map[string]bool)
+	for _, room := range w.World.FindAll(RoomClassName) {
+		name, _ := room.Get("name").(string)
+		if seen[name] {
+			return nil, fmt.Errorf("can't export because there's more than one room named \"%s\"", name)
+		}
+		seen[name] = true
+		roomNames[room.ID] = name
+	}
+
+	for _, room := range w.World.FindAll(RoomClassName) {
+		roomDef := &RoomDefinition{Name: roomNames[room.ID], Properties: exportProperties(room, "name", "description")}
+		if classDef := room.state().classDef; classDef != w.Room && !isBuiltinRoom(roomDef.Name) {
+			roomDef.Class = classDef.Name
+		}
+		roomDef.Description = exportDescription(room)
+
+		for _, thing := range FilterByClass(room.Children(), ThingClassName) {
+			classDef := thing.state().classDef
+			if !thing.IsInstanceOf(ExitClassName) {
+				itemDef := &ItemDefinition{Description: exportDescription(thing), Properties: exportProperties(thing, "name", "description")}
+				itemDef.Name, _ = thing.Get("name").(string)
+				if classDef != w.Item {
+					itemDef.Class = classDef.Name
+				}
+				roomDef.Items = append(roomDef.Items, itemDef)
+				continue
+			}
+
+			destination, _ := thing.GetRef("destination")
+			if destination == nil {
+				// nowhere to go, so there's nothing to write down
+				continue
+			}
+			exitDef := &ExitDefinition{To: roomNames[destination.ID], Properties: exportProperties(thing, "name", "destination", "key")}
+			if name := thing.state().properties["name"]; name != classDef.initialProperties["name"] {
+				exitDef.Name, _ = name.(string)
+			}
+			if thing.IsInstanceOf(LockedExitClassName) {
+				exitDef.Locked = true
+				// keys which aren't lying in a room won't be in the definition
+				if key, _ := thing.GetRef("key"); key != nil && key.Parent() != nil && key.Parent().IsInstanceOf(RoomClassName) {
+					exitDef.Key, _ = key.Get("name").(string)
+				}
+			}
+			if classDef != w.Exit && classDef != w.LockedExit {
+				exitDef.Class = classDef.Name
+			}
+			roomDef.Exits = append(roomDef.Exits, exitDef)
+		}
+		def.Rooms = append(def.Rooms, roomDef)
+	}
+	return def, nil
+}
+
+func exportDescription(obj *Object) string {
+	state := obj.state()
+	if description, ok := state.properties["description"].(string); ok && description != state.classDef.initialProperties["description"] {
+		return description
+	}
+	return ""
+}
+
+// exportProperties returns the properties of obj which have been changed from
+// their initial values, other than the ones named in skip
+func exportProperties(obj *Object, skip ...string) map[string]interface{} {
+	state := obj.state()
+	var properties map[string]interface{}
+	for name, value := range state.properties {
+		if containsString(skip, name) || reflect.DeepEqual(value, state.classDef.initialProperties[name]) {
+			continue
+		}
+		if _, isRef := value.(ObjectRef); isRef {
+			continue
+		}
+		if list, isList := value.([]interface{}); isList && containsRef(list) {
+			continue
+		}
+		if properties == nil {
+			properties = make(map[string]interface{})
+		}
+		properties[name] = value
+	}
+	return properties
+}
+
+// LoadWorldFile reads a world definition and returns a function which builds a
+// fresh copy of that world, suitable for passing to Start.
+func LoadWorldFile(path string) (func() *WorldBasics, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	def, err := ParseWorldDefinition(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// build it once now so that any errors which depend on the classes (ie: unknown class
+	// names) are reported up front instead of when the first game starts
+	err = def.Build(NewWorldBasics(NewWorld()))
+	if err != nil {
+		return nil, err
+	}
+
+	return func() *WorldBasics {
+		basics := NewWorldBasics(NewWorld())
+		err := def.Build(basics)
+		if err != nil {
+			panic(fmt.Sprintf("world definition %s could not be built: %v", path, err))
+		}
+		return basics
+	}, nil
+}
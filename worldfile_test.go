@@ -0,0 +1,150 @@
+package muddy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pgm/muddy"
+	"github.com/stretchr/testify/assert"
+)
+
+const tinylandYAML = `
+rooms:
+  - name: lobby
+    description: A grand lobby. A [door] leads to the beach.
+    exits:
+      - to: Beach
+        name: door
+  - name: Beach
+    description: Sand as far as the eye can see. There's a [shell] here.
+    items:
+      - name: shell
+        properties:
+          weight: 2
+          colors: [pink, white]
+    exits:
+      - to: lobby
+      - to: Castle
+        locked: true
+        key: shell
+  - name: Castle
+    description: A drafty castle
+    exits:
+      - to: Beach
+`
+
+func writeWorldFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "world.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadWorldFile(t *testing.T) {
+	builder, err := muddy.LoadWorldFile(writeWorldFile(t, tinylandYAML))
+	assert.Nil(t, err)
+
+	basic := builder()
+	assert.Equal(t, "A grand lobby. A [door] leads to the beach.", basic.Lobby.Get("description"))
+
+	door := basic.Lobby.Children()[0]
+	assert.True(t, door.IsInstanceOf(muddy.ExitClassName))
+	assert.Equal(t, "door", door.Get("name"))
+
+	beach := door.Call(&muddy.Context{}, "getDestination").(*muddy.Object)
+	assert.Equal(t, "Beach", beach.Get("name"))
+
+	shell := beach.Children()[0]
+	assert.True(t, shell.IsInstanceOf(muddy.ItemClassName))
+	assert.Equal(t, 2, shell.Get("weight"))
+	assert.Equal(t, []interface{}{"pink", "white"}, shell.Get("colors"))
+
+	toCastle := beach.Children()[2]
+	assert.True(t, toCastle.IsInstanceOf(muddy.LockedExitClassName))
+	assert.Equal(t, true, toCastle.Get("locked"))
+	assert.Equal(t, shell, toCastle.Get("key"))
+
+	// each call builds an independent world
+	assert.NotEqual(t, basic.World, builder().World)
+}
+
+func TestWorldFileErrors(t *testing.T) {
+	cases := []struct {
+		content string
+		message string
+	}{
+		{"rooms:\n  - name: Beach\n  - name: Beach\n", ":3:5: duplicate room \"Beach\" (first defined at line 2)"},
+		{"rooms:\n  - name: Beach\n    exits:\n      - to: Moon\n", ":4:9: exit from \"Beach\" leads to unknown room \"Moon\""},
+		{"rooms:\n  - name: Beach\n    class: Spaceship\n", ":2:5: unknown class \"Spaceship\""},
+		{"rooms:\n  - name: Beach\n    items:\n      - name: shell\n      - name: shell\n", ":5:9: duplicate item \"shell\" in room \"Beach\" (first defined at line 4)"},
+		{"rooms:\n  - name: Beach\n    colour: blue\n", ":3:5: unknown field \"colour\""},
+		{"rooms:\n  - description: nameless\n", ":2:5: missing required field \"name\""},
+		{"rooms:\n  - name: Beach\n    exits:\n      - to: Beach\n        locked: true\n        key: shell\n", ":4:9: key \"shell\" is not an item"},
+		{"rooms:\n  - name: Beach\n    exits:\n      - to: Beach\n        key: shell\n", ":5:14: only locked exits can have a key"},
+	}
+
+	for _, c := range cases {
+		path := writeWorldFile(t, c.content)
+		_, err := muddy.LoadWorldFile(path)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), path+c.message)
+		}
+	}
+}
+
+func TestBuildAndExport(t *testing.T) {
+	builder, err := muddy.LoadWorldFile(writeWorldFile(t, tinylandYAML))
+	assert.Nil(t, err)
+	basic := builder()
+	world := basic.World
+
+	alice := basic.AddPlayer("", basic.Nowhere)
+	bob := basic.AddPlayer("", basic.Nowhere)
+	aliceCtx := &muddy.Context{Player: alice, World: world}
+	bobCtx := &muddy.Context{Player: bob, World: world}
+	alice.Call(aliceCtx, "setName", "alice")
+	bob.Call(bobCtx, "setName", "bob")
+	// as if alice connected with the builder token
+	alice.Set("builder", true)
+
+	// only builders get the build section, and the actions in it
+	assert.Nil(t, sectionLabels(world.GetView(bob.ID), "build"))
+	_, err = basic.Lobby.TryCall(bobCtx, "Dig", "Cellar")
+	assert.NotNil(t, err)
+	view := world.GetView(alice.ID)
+	assert.Equal(t, []string{"lobby", "door"}, sectionLabels(view, "build"))
+	assert.True(t, view.HasAction(basic.Lobby.ID, "Dig", []string{"Cellar"}))
+
+	basic.Lobby.Call(aliceCtx, "Rename", "lobby")
+	basic.Lobby.Call(aliceCtx, "Describe", "A dusty lobby")
+	basic.Lobby.Call(aliceCtx, "Dig", "Cellar")
+	basic.Lobby.Call(aliceCtx, "CreateItem", "broom")
+	broom := basic.Lobby.Children()[len(basic.Lobby.Children())-1]
+	broom.Call(aliceCtx, "Describe", "Well worn")
+	broom.Set("sweeps", 3)
+	door := basic.Lobby.Children()[0]
+	door.Call(aliceCtx, "Rename", "front door")
+	assert.Equal(t, []string{"front door", "Cellar"}, sectionLabels(world.GetView(alice.ID), "exits"))
+
+	def, err := basic.ExportDefinition()
+	assert.Nil(t, err)
+	data, err := def.Marshal()
+	assert.Nil(t, err)
+
+	// the exported world loads back in with the builders' changes
+	reloaded, err := muddy.LoadWorldFile(writeWorldFile(t, string(data)))
+	assert.Nil(t, err)
+	rebuilt := reloaded()
+	lobby := rebuilt.Lobby
+	assert.Equal(t, "A dusty lobby", lobby.Get("description"))
+	assert.Equal(t, []string{"front door", "Cellar"}, sectionLabels(rebuilt.World.GetView(rebuilt.AddPlayer("carol", lobby).ID), "exits"))
+	broom = muddy.FilterByClass(lobby.Children(), muddy.ItemClassName)[0]
+	assert.Equal(t, "broom", broom.Get("name"))
+	assert.Equal(t, "Well worn", broom.Get("description"))
+	assert.Equal(t, 3, broom.Get("sweeps"))
+
+	beach := lobby.Children()[1].Call(&muddy.Context{}, "getDestination").(*muddy.Object)
+	toCastle := beach.Children()[2]
+	assert.True(t, toCastle.IsInstanceOf(muddy.LockedExitClassName))
+	assert.Equal(t, beach.Children()[0], toCastle.Get("key"))
+}